@@ -0,0 +1,87 @@
+// Command mds runs the hub on its own, configured by a JSON file:
+//
+//	mds -config hub.json
+//
+// Without -config it listens on :9000 with the defaults. SIGINT or SIGTERM
+// shut it down gracefully.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"message-delivery-system/internal/server"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path of the JSON configuration file")
+	flag.Parse()
+
+	err := run(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mds:", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string) error {
+	config := server.DefaultConfig()
+	if configPath != "" {
+		var err error
+		config, err = server.LoadConfig(configPath)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Listen.Address == "" {
+		return errors.New("listen.address must be set")
+	}
+	options, err := config.Options()
+	if err != nil {
+		return err
+	}
+	srv := server.New(options...)
+	logger := srv.Logger()
+
+	listeners := []struct {
+		address string
+		start   func(laddr *net.TCPAddr) error
+	}{
+		{config.Listen.Address, srv.Start},
+		{config.Listen.WebSocket, srv.StartWebSocket},
+		{config.Listen.Admin, srv.StartAdmin},
+		{config.Listen.Metrics, srv.StartMetrics},
+	}
+	for i, listener := range listeners {
+		if listener.address == "" {
+			continue
+		}
+		laddr, err := net.ResolveTCPAddr("tcp", listener.address)
+		if err == nil {
+			err = listener.start(laddr)
+		}
+		if err != nil {
+			if i > 0 {
+				// The hub itself was started first.
+				srv.Stop()
+			}
+			return err
+		}
+	}
+	logger.Info("Hub started", "address", config.Listen.Address, "websocket", config.Listen.WebSocket, "admin", config.Listen.Admin, "metrics", config.Listen.Metrics)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	logger.Info("Shutting down the hub", "timeout", time.Duration(config.Timeouts.Shutdown))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeouts.Shutdown))
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
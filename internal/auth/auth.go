@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	ErrExpiredCredentials = errors.New("auth: credentials expired")
+)
+
+// Identity is what an Authenticator learned about a client from its credentials.
+// An empty Subject means the client is allowed in but stays anonymous.
+type Identity struct {
+	Subject string
+}
+
+// Authenticator checks the credentials a client presents in its `hello` frame.
+type Authenticator interface {
+	Authenticate(credentials []byte) (Identity, error)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMACAuthenticator admits clients presenting a token signed with the shared
+// key by SignHMACToken. The subject of the token becomes the client's identity.
+//
+// Token format: base64url(subject) "." expiry in unix seconds "." base64url(HMAC-SHA256)
+type HMACAuthenticator struct {
+	key []byte
+	now func() time.Time
+}
+
+func NewHMACAuthenticator(key []byte) *HMACAuthenticator {
+	return &HMACAuthenticator{key: key, now: time.Now}
+}
+
+// SignHMACToken issues a token for the subject that is valid until expiresAt.
+func SignHMACToken(key []byte, subject string, expiresAt time.Time) []byte {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return []byte(claims + "." + base64.RawURLEncoding.EncodeToString(sign(key, claims)))
+}
+
+func (authenticator *HMACAuthenticator) Authenticate(credentials []byte) (Identity, error) {
+	parts := strings.Split(string(credentials), ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(authenticator.key, parts[0]+"."+parts[1])) {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	subject, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(subject) == 0 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if authenticator.now().Unix() >= expiresAt {
+		return Identity{}, ErrExpiredCredentials
+	}
+
+	return Identity{Subject: string(subject)}, nil
+}
+
+func sign(key []byte, claims string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(claims))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	key := []byte("signing-key")
+	authenticator := NewHMACAuthenticator(key)
+
+	token := SignHMACToken(key, "alice", time.Now().Add(time.Hour))
+	identity, err := authenticator.Authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Subject: "alice"}, identity)
+
+	forged := SignHMACToken([]byte("other-key"), "alice", time.Now().Add(time.Hour))
+	_, err = authenticator.Authenticate(forged)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	expired := SignHMACToken(key, "alice", time.Now().Add(-time.Second))
+	_, err = authenticator.Authenticate(expired)
+	assert.Equal(t, ErrExpiredCredentials, err)
+
+	_, err = authenticator.Authenticate([]byte("not-a-token"))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestHMACAuthenticatorRejectsTamperedSubject(t *testing.T) {
+	key := []byte("signing-key")
+	parts := strings.Split(string(SignHMACToken(key, "alice", time.Now().Add(time.Hour))), ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte("mallory"))
+
+	_, err := NewHMACAuthenticator(key).Authenticate([]byte(strings.Join(parts, ".")))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
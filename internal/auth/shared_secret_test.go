@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSharedSecretAuthenticator(t *testing.T) {
+	authenticator := NewSharedSecretAuthenticator([]byte("s3cret"))
+
+	identity, err := authenticator.Authenticate([]byte("s3cret"))
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{}, identity)
+
+	_, err = authenticator.Authenticate([]byte("wrong"))
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	_, err = authenticator.Authenticate(nil)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestSharedSecretAuthenticatorWithoutSecretRejectsEverybody(t *testing.T) {
+	_, err := NewSharedSecretAuthenticator(nil).Authenticate(nil)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
@@ -1,222 +1,804 @@
 package client
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
+	"log/slog"
+	"message-delivery-system/internal/protocol"
+	"message-delivery-system/internal/websocket"
 	"net"
+	"net/url"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// incomingBufferSize is how many relayed messages, and separately presence
+// events, are buffered while nobody is consuming them. Once a buffer is full
+// further ones are dropped and counted, so responses to requests are not held
+// up behind them.
+const incomingBufferSize = 1024
+
+var ErrNotConnected = errors.New("client: not connected")
+
+// aLongTimeAgo is a deadline in the past, set to interrupt blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// writeTimeout bounds the writes of frames whose context has no deadline, such
+// as SendMsg and the answers to pings, so a hub that stops reading does not
+// hold up every later write.
+var writeTimeout = 10 * time.Second
+
+// ErrServerGoingAway is returned for new requests once the hub announced it is
+// shutting down, and for requests that were still waiting when it closed the
+// connection.
+var ErrServerGoingAway = errors.New("client: hub is going away")
+
+// IncomingMessage is a message relayed to the client, or published to a topic
+// it subscribes to, in which case Topic is set.
 type IncomingMessage struct {
 	SenderID uint64
 	Body     []byte
+	Topic    string
+}
+
+// DeliveryReport tells which recipients of a message the hub delivered it to,
+// which were not connected and which could not be written to.
+type DeliveryReport struct {
+	Delivered []uint64
+	Offline   []uint64
+	Failed    []uint64
 }
 
 type Client struct {
-	connection net.Conn
-	mutex      sync.RWMutex
+	connection   net.Conn
+	writer       *protocol.Writer
+	version      byte
+	codec        protocol.Codec
+	sessionToken string
+	credentials  []byte
+	tlsConfig    *tls.Config
+	// requestedCodec is the codec asked for in the `hello`, nil for the default.
+	requestedCodec protocol.Codec
+	webSocketPath  string
+	backoff        *Backoff
+	heartbeat      heartbeatOptions
+	// logger is the logger set through WithLogger and connectionLogger the one
+	// of the current connection, with its connection_id and user_id.
+	logger           *slog.Logger
+	connectionLogger *slog.Logger
+	nextConnectionID uint64
+	nextRequestID    uint32
+	// done is closed by the reader goroutine of the current connection when it exits.
+	done      chan struct{}
+	readErr   error
+	goingAway bool
+	// timedOut is set when the connection was closed for not answering a ping.
+	timedOut bool
+	stream   *stream
+	// topics and presenceSubscribed are the subscriptions made again after
+	// reconnecting.
+	topics             map[string]struct{}
+	presenceSubscribed bool
+	incoming           chan IncomingMessage
+	presence           chan PresenceEvent
+	// droppedMessages and droppedPresenceEvents count the pushes dropped
+	// because their buffer was full.
+	droppedMessages       uint64
+	droppedPresenceEvents uint64
+	pending               map[uint32]chan protocol.Frame
+	pendingMutex          sync.Mutex
+	// writeLock keeps the write deadline of one request from applying to
+	// another's frame. It is a channel so waiting for it can be given up.
+	writeLock     chan struct{}
+	stateHandlers []func(change StateChange)
+	stateMutex    sync.RWMutex
+	mutex         sync.RWMutex
 }
 
 func New() *Client {
-	return &Client{connection: nil, mutex: sync.RWMutex{}}
+	return &Client{
+		connection: nil,
+		logger:     slog.Default(),
+		incoming:   make(chan IncomingMessage, incomingBufferSize),
+		presence:   make(chan PresenceEvent, incomingBufferSize),
+		pending:    make(map[uint32]chan protocol.Frame),
+		topics:     make(map[string]struct{}),
+		writeLock:  make(chan struct{}, 1),
+		mutex:      sync.RWMutex{},
+	}
+}
+
+// Connect connects to the hub. Unless told otherwise through options, it
+// resumes the session of the previous connection so the user ID is kept. It
+// does not retry, even with WithReconnect, which only applies once connected.
+// A connection made by an earlier call is closed once the new one is ready.
+func (client *Client) Connect(serverAddr *net.TCPAddr, opts ...ConnectOption) error {
+	return client.ConnectContext(context.Background(), serverAddr, opts...)
+}
+
+// ConnectContext is like Connect but gives up dialing and the handshake when
+// ctx is done, returning ctx.Err().
+func (client *Client) ConnectContext(ctx context.Context, serverAddr *net.TCPAddr, opts ...ConnectOption) error {
+	client.mutex.RLock()
+	options := connectOptions{sessionToken: client.sessionToken, credentials: client.credentials, tlsConfig: client.tlsConfig, codec: client.requestedCodec, webSocketPath: client.webSocketPath, logger: client.logger, backoff: client.backoff, heartbeat: client.heartbeat}
+	client.mutex.RUnlock()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	stream := newStream()
+	err := client.connect(ctx, serverAddr, options, stream, 0)
+	if err != nil {
+		stream.cancel()
+	}
+	return err
 }
 
-func (client *Client) Connect(serverAddr *net.TCPAddr) error {
-	connection, err := net.Dial("tcp", serverAddr.String())
+// connect makes one attempt to connect as part of the stream.
+func (client *Client) connect(ctx context.Context, serverAddr *net.TCPAddr, options connectOptions, stream *stream, attempt int) error {
+	client.emit(Connecting, attempt, nil)
+	logger := options.logger.With("connection_id", atomic.AddUint64(&client.nextConnectionID, 1))
+
+	var connection net.Conn
+	var err error
+	switch {
+	case options.webSocketPath != "":
+		connection, err = dialWebSocket(ctx, serverAddr, options.webSocketPath, options.tlsConfig)
+	case options.tlsConfig != nil:
+		dialer := tls.Dialer{Config: options.tlsConfig}
+		connection, err = dialer.DialContext(ctx, "tcp", serverAddr.String())
+	default:
+		var dialer net.Dialer
+		connection, err = dialer.DialContext(ctx, "tcp", serverAddr.String())
+	}
+	if err != nil {
+		err = contextError(ctx, err)
+		logger.Warn("Connecting to the hub failed", "address", serverAddr.String(), "error", err)
+		client.emit(Disconnected, attempt, err)
+		return err
+	}
+
+	hello := protocol.Hello{
+		MinVersion:   protocol.MinVersion,
+		MaxVersion:   protocol.Version,
+		SessionToken: options.sessionToken,
+		Credentials:  options.credentials,
+	}
+	if options.codec != nil {
+		hello.Codec = options.codec.Name()
+	}
+	reader, writer := protocol.NewReader(connection), protocol.NewWriter(connection)
+	welcome, err := handshake(ctx, connection, reader, writer, hello)
 	if err != nil {
-		fmt.Errorf(err.Error())
+		logger.Warn("Handshake failed", "address", serverAddr.String(), "error", err)
+		connection.Close()
+		client.emit(Disconnected, attempt, err)
 		return err
 	}
 
+	codec := negotiatedCodec(welcome, options.codec)
+	logger = logger.With("user_id", welcome.UserID)
+	logger.Info("Connected to the hub", "address", serverAddr.String(), "resumed", welcome.Resumed, "version", welcome.Version, "codec", codec.Name())
+
+	// Reconnecting resumes the session of this connection.
+	options.sessionToken = welcome.SessionToken
+
+	err = client.endPreviousStream(ctx, stream)
+	if err != nil {
+		connection.Close()
+		client.emit(Disconnected, attempt, err)
+		return err
+	}
+
+	done := make(chan struct{})
 	client.mutex.Lock()
+	if stream.ctx.Err() != nil {
+		client.mutex.Unlock()
+		connection.Close()
+		client.emit(Disconnected, attempt, stream.ctx.Err())
+		return stream.ctx.Err()
+	}
+	client.stream = stream
 	client.connection = connection
+	client.writer = writer
+	client.version = welcome.Version
+	client.codec = codec
+	client.sessionToken = welcome.SessionToken
+	client.credentials = options.credentials
+	client.tlsConfig = options.tlsConfig
+	client.requestedCodec = options.codec
+	client.webSocketPath = options.webSocketPath
+	client.backoff = options.backoff
+	client.heartbeat = options.heartbeat
+	client.logger = options.logger
+	client.connectionLogger = logger
+	client.done = done
+	client.readErr = nil
+	client.goingAway = false
+	client.timedOut = false
 	client.mutex.Unlock()
 
+	client.emit(Connected, attempt, nil)
+	go func() {
+		err := client.readLoop(reader, done, logger)
+		client.reconnect(serverAddr, options, stream, err)
+	}()
+	if options.heartbeat.interval > 0 {
+		go client.ping(connection, done, options.heartbeat, logger)
+	}
+
 	return nil
 }
 
+// endPreviousStream stops the stream of an earlier call to Connect, closes its
+// connection and waits until its reader is done, so the connections of two
+// streams never deliver messages side by side.
+func (client *Client) endPreviousStream(ctx context.Context, stream *stream) error {
+	client.mutex.RLock()
+	previous, connection := client.stream, client.connection
+	client.mutex.RUnlock()
+	if previous == nil || previous == stream {
+		return nil
+	}
+
+	previous.cancel()
+	connection.Close()
+	select {
+	case <-previous.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SessionToken returns the token of the current session. It can be passed to
+// WithSessionToken to keep the same user ID on a new connection.
+func (client *Client) SessionToken() string {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	return client.sessionToken
+}
+
+// Close closes the connection and stops reconnecting.
 func (client *Client) Close() error {
-	err := client.connection.Close()
+	client.mutex.RLock()
+	connection, stream := client.connection, client.stream
+	client.mutex.RUnlock()
+	if stream != nil {
+		stream.cancel()
+	}
+
+	err := connection.Close()
 	if err != nil {
-		fmt.Errorf("Error closing connection for client: %s", err.Error())
+		client.log().Warn("Closing the connection failed", "error", err)
 	}
 
 	return err
 }
 
 func (client *Client) WhoAmI() (uint64, error) {
+	return client.WhoAmIContext(context.Background())
+}
+
+// WhoAmIContext is like WhoAmI but gives up when ctx is done.
+func (client *Client) WhoAmIContext(ctx context.Context) (uint64, error) {
 	var userID uint64
-	requestType := "who_am_i"
 
-	err := client.sendRequestTypeToServer(requestType)
+	response, err := client.request(ctx, protocol.FrameWhoAmI, nil, protocol.FrameWhoAmIResponse)
 	if err != nil {
-		fmt.Errorf("Error sending `who_am_i` request to server: %s", err.Error())
+		client.log().Warn("Request failed", "message_type", protocol.FrameWhoAmI.String(), "error", err)
 		return userID, err
 	}
-
-	userIDBuffer := make([]byte, 8)
-	client.mutex.RLock()
-	_, err = client.connection.Read(userIDBuffer)
-	client.mutex.RUnlock()
-	if err != nil {
-		fmt.Errorf("Error reading userID from server: %s", err.Error())
-		return userID, err
+	if len(response.Payload) < 8 {
+		client.log().Error("Malformed response", "message_type", protocol.FrameWhoAmI.String(), "error", protocol.ErrMalformedPayload)
+		return userID, protocol.ErrMalformedPayload
 	}
-	userID = binary.LittleEndian.Uint64(userIDBuffer)
+	userID = binary.LittleEndian.Uint64(response.Payload)
 
 	return userID, nil
 }
 
 func (client *Client) ListClientIDs() ([]uint64, error) {
-	var userIDs []uint64
-	requestType := "who_is_here"
-
-	err := client.sendRequestTypeToServer(requestType)
-	if err != nil {
-		fmt.Errorf("Error sending `who_is_here` request to server: %s", err.Error())
-		return userIDs, err
-	}
+	return client.ListClientIDsContext(context.Background())
+}
 
-	userIDsLengthBuffer := make([]byte, 1)
-	client.mutex.RLock()
-	_, err = client.connection.Read(userIDsLengthBuffer)
-	client.mutex.RUnlock()
-	if err != nil {
-		fmt.Errorf("Error reading `who_is_here` response from server: %s", err.Error())
-		return userIDs, err
-	}
-	userIDsLength, err := binary.ReadUvarint(bytes.NewBuffer(userIDsLengthBuffer))
-	if err != nil {
-		fmt.Errorf("Incorrect `who_is_here` response from server: %s", err.Error())
-		return userIDs, err
-	}
+// ListClientIDsContext is like ListClientIDs but gives up when ctx is done.
+func (client *Client) ListClientIDsContext(ctx context.Context) ([]uint64, error) {
+	var userIDs []uint64
 
-	userIDsBuffer := make([]byte, userIDsLength)
-	client.mutex.RLock()
-	_, err = client.connection.Read(userIDsBuffer)
-	client.mutex.RUnlock()
+	response, err := client.request(ctx, protocol.FrameWhoIsHere, nil, protocol.FrameWhoIsHereResponse)
 	if err != nil {
-		fmt.Errorf("Error in `relay` reading receivers list: %s", err.Error())
+		client.log().Warn("Request failed", "message_type", protocol.FrameWhoIsHere.String(), "error", err)
 		return userIDs, err
 	}
 
-	gobBuffer := gob.NewDecoder(bytes.NewBuffer(userIDsBuffer))
-	err = gobBuffer.Decode(&userIDs)
+	userIDs, err = protocol.DecodeUserIDs(client.currentCodec(), response.Payload)
 	if err != nil {
-		fmt.Errorf("Error in `who_is_here` response decoding userIDs: %s", err.Error())
+		client.log().Error("Malformed response", "message_type", protocol.FrameWhoIsHere.String(), "error", err)
 		return userIDs, err
 	}
 
 	return userIDs, nil
 }
 
+// SendMsg relays a message without waiting for the hub's delivery status.
+// Writing the message gives up after 10 seconds.
 func (client *Client) SendMsg(recipients []uint64, body []byte) error {
-	var recipientsBuffer bytes.Buffer
-	gobBuffer := gob.NewEncoder(&recipientsBuffer)
-	err := gobBuffer.Encode(recipients)
+	return client.SendMsgContext(context.Background(), recipients, body)
+}
+
+// SendMsgContext is like SendMsg but gives up writing the message when ctx is
+// done.
+func (client *Client) SendMsgContext(ctx context.Context, recipients []uint64, body []byte) error {
+	payload, err := protocol.EncodeRelay(client.currentCodec(), recipients, body)
 	if err != nil {
-		fmt.Errorf("Error encoding recipients: %s", err.Error())
+		client.log().Warn("Encoding request failed", "message_type", protocol.FrameRelay.String(), "error", err)
 		return err
 	}
 
-	requestType := "relay"
-
-	err = client.sendRequestTypeToServer(requestType)
+	err = client.send(ctx, protocol.FrameRelay, payload)
 	if err != nil {
-		fmt.Errorf("Error sending `relay` request to server: %s", err.Error())
+		client.log().Warn("Request failed", "message_type", protocol.FrameRelay.String(), "error", err)
 		return err
 	}
 
-	recipientsLength := len(recipientsBuffer.Bytes())
-	_, err = client.connection.Write([]byte{byte(recipientsLength)})
+	return nil
+}
+
+// Broadcast relays a message to every other connected user without waiting
+// for the hub's delivery status. Writing the message gives up after 10
+// seconds.
+func (client *Client) Broadcast(body []byte) error {
+	return client.BroadcastContext(context.Background(), body)
+}
+
+// BroadcastContext is like Broadcast but gives up writing the message when ctx
+// is done.
+func (client *Client) BroadcastContext(ctx context.Context, body []byte) error {
+	err := client.send(ctx, protocol.FrameBroadcast, protocol.EncodeBroadcast(body))
 	if err != nil {
-		fmt.Errorf("Error sending `relay` request to server: %s", err.Error())
+		client.log().Warn("Request failed", "message_type", protocol.FrameBroadcast.String(), "error", err)
 		return err
 	}
 
-	_, err = client.connection.Write(recipientsBuffer.Bytes())
+	return nil
+}
+
+// SendMsgWithReceipt relays a message like SendMsg, then blocks until the hub
+// reports the delivery status of every recipient or ctx is done.
+func (client *Client) SendMsgWithReceipt(ctx context.Context, recipients []uint64, body []byte) (DeliveryReport, error) {
+	var report DeliveryReport
+
+	payload, err := protocol.EncodeRelay(client.currentCodec(), recipients, body)
 	if err != nil {
-		fmt.Errorf("Error sending `who_is_here` response to client: %s", err.Error())
-		return err
+		client.log().Warn("Encoding request failed", "message_type", protocol.FrameRelay.String(), "error", err)
+		return report, err
 	}
 
-	var messageLength uint32
-	messageLength = uint32(len(body))
-	msgLengthBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(msgLengthBytes, messageLength)
-	_, err = client.connection.Write(msgLengthBytes)
+	response, err := client.request(ctx, protocol.FrameRelay, payload, protocol.FrameRelayStatus)
 	if err != nil {
-		fmt.Errorf("Error sending `relay` request to server: %s", err.Error())
-		return err
+		client.log().Warn("Request failed", "message_type", protocol.FrameRelay.String(), "error", err)
+		return report, err
 	}
 
-	_, err = client.connection.Write(body)
+	status, err := protocol.DecodeRelayStatus(client.currentCodec(), response.Payload)
 	if err != nil {
-		fmt.Errorf("Error sending `relay` request to server: %s", err.Error())
-		return err
+		client.log().Error("Malformed response", "message_type", protocol.FrameRelay.String(), "error", err)
+		return report, err
 	}
 
-	return nil
+	report = DeliveryReport{Delivered: status.Delivered, Offline: status.Offline, Failed: status.Failed}
+	return report, nil
 }
 
+// HandleIncomingMessages forwards relayed messages to writeCh until the
+// connection is closed. With WithReconnect it goes on over the connections
+// that follow, until Close or until reconnecting fails.
 func (client *Client) HandleIncomingMessages(writeCh chan<- IncomingMessage) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("recovered from writing to a closed incoming messages channel")
+			client.log().Error("Recovered from writing to a closed incoming messages channel", "panic", r)
 			return
 		}
 	}()
 
+	client.mutex.RLock()
+	stream := client.stream
+	client.mutex.RUnlock()
+	if stream == nil {
+		return
+	}
+	done := stream.done
+
 	for {
-		senderIDBuffer := make([]byte, 8)
-		client.mutex.RLock()
-		_, err := client.connection.Read(senderIDBuffer)
-		client.mutex.RUnlock()
-		if err != nil {
-			fmt.Errorf("Error reading senderID from server: %s", err.Error())
-			return
+		select {
+		case incomingMessage := <-client.incoming:
+			writeCh <- incomingMessage
+		case <-done:
+			for {
+				select {
+				case incomingMessage := <-client.incoming:
+					writeCh <- incomingMessage
+				default:
+					return
+				}
+			}
 		}
-		senderID := binary.LittleEndian.Uint64(senderIDBuffer)
+	}
+}
 
-		messageLengthBuffer := make([]byte, 4)
-		client.mutex.RLock()
-		_, err = client.connection.Read(messageLengthBuffer)
-		client.mutex.RUnlock()
+// DroppedMessages returns how many relayed messages were dropped because
+// incomingBufferSize of them were waiting for HandleIncomingMessages.
+func (client *Client) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&client.droppedMessages)
+}
+
+// deliver queues a relayed message for HandleIncomingMessages without
+// blocking the reader.
+func (client *Client) deliver(message IncomingMessage, frame protocol.Frame, logger *slog.Logger) {
+	select {
+	case client.incoming <- message:
+	default:
+		dropped := atomic.AddUint64(&client.droppedMessages, 1)
+		logDropped(logger, frame, dropped)
+	}
+}
+
+// logDropped warns about the first push dropped by the client; the following
+// ones are only logged at Debug.
+func logDropped(logger *slog.Logger, frame protocol.Frame, dropped uint64) {
+	level := slog.LevelDebug
+	if dropped == 1 {
+		level = slog.LevelWarn
+	}
+	logger.Log(context.Background(), level, "Dropping push, nobody is consuming them", "message_type", frame.Type.String(), "dropped", dropped)
+}
+
+// readLoop is the only reader of the connection. It routes responses to the
+// request waiting for them and queues relayed messages for HandleIncomingMessages.
+// It returns why the connection ended.
+func (client *Client) readLoop(reader *protocol.Reader, done chan struct{}, logger *slog.Logger) error {
+	defer close(done)
+
+	for {
+		frame, err := reader.ReadFrame()
 		if err != nil {
-			fmt.Errorf("Error in `incoming_message` reading message length: %s", err.Error())
-			return
+			client.mutex.Lock()
+			if client.goingAway {
+				err = ErrServerGoingAway
+			}
+			if client.timedOut {
+				err = ErrHeartbeatTimeout
+			}
+			logger.Info("Disconnected from the hub", "error", err)
+			client.readErr = err
+			client.mutex.Unlock()
+			return err
 		}
-		var messageLength uint32
-		messageLength = binary.LittleEndian.Uint32(messageLengthBuffer)
 
-		messageBuffer := make([]byte, messageLength)
-		client.mutex.RLock()
-		_, err = client.connection.Read(messageBuffer)
-		client.mutex.RUnlock()
-		if err != nil {
-			fmt.Errorf("Error in `incoming_message` reading message: %s", err.Error())
-			return
+		switch frame.Type {
+		case protocol.FrameMessage:
+			senderID, body, err := protocol.DecodeMessage(frame.Payload)
+			if err != nil {
+				logger.Error("Malformed frame", "message_type", frame.Type.String(), "error", err)
+				continue
+			}
+			client.deliver(IncomingMessage{SenderID: senderID, Body: body}, frame, logger)
+		case protocol.FrameTopicMessage:
+			topic, senderID, body, err := protocol.DecodeTopicMessage(frame.Payload)
+			if err != nil {
+				logger.Error("Malformed frame", "message_type", frame.Type.String(), "error", err)
+				continue
+			}
+			client.deliver(IncomingMessage{SenderID: senderID, Body: body, Topic: topic}, frame, logger)
+		case protocol.FrameUserJoined, protocol.FrameUserLeft:
+			userID, err := protocol.DecodeUserID(frame.Payload)
+			if err != nil {
+				logger.Error("Malformed frame", "message_type", frame.Type.String(), "error", err)
+				continue
+			}
+			event := PresenceEvent{Type: UserJoined, UserID: userID}
+			if frame.Type == protocol.FrameUserLeft {
+				event.Type = UserLeft
+			}
+			select {
+			case client.presence <- event:
+			default:
+				dropped := atomic.AddUint64(&client.droppedPresenceEvents, 1)
+				logDropped(logger, frame, dropped)
+			}
+		case protocol.FramePing:
+			go client.pong(frame, logger)
+		case protocol.FrameGoingAway:
+			// Keep reading: the hub still answers the requests it received
+			// and then closes the connection.
+			reason, _ := protocol.DecodeGoingAway(frame.Payload)
+			logger.Info("Hub is going away", "message_type", frame.Type.String(), "reason", reason)
+			client.mutex.Lock()
+			client.goingAway = true
+			client.mutex.Unlock()
+		default:
+			client.pendingMutex.Lock()
+			responseCh, ok := client.pending[frame.RequestID]
+			delete(client.pending, frame.RequestID)
+			client.pendingMutex.Unlock()
+			if !ok {
+				// The hub answers every relay, also the ones sent by SendMsg
+				// and Broadcast without waiting for the status.
+				level := slog.LevelWarn
+				if frame.Type == protocol.FrameRelayStatus {
+					level = slog.LevelDebug
+				}
+				logger.Log(context.Background(), level, "Dropping response to unknown request", "message_type", frame.Type.String(), "request_id", frame.RequestID)
+				continue
+			}
+			responseCh <- frame
 		}
+	}
+}
+
+func dialWebSocket(ctx context.Context, serverAddr *net.TCPAddr, path string, tlsConfig *tls.Config) (net.Conn, error) {
+	target := url.URL{Scheme: "ws", Host: serverAddr.String(), Path: path}
+	if tlsConfig != nil {
+		target.Scheme = "wss"
+	}
+	connection, err := websocket.DialContext(ctx, target.String(), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
 
-		incomingMessage := IncomingMessage{SenderID: senderID, Body: messageBuffer}
+// handshake sends a `hello` frame and waits for the server to welcome the
+// client, until ctx is done.
+func handshake(ctx context.Context, connection net.Conn, reader *protocol.Reader, writer *protocol.Writer, hello protocol.Hello) (protocol.Welcome, error) {
+	var welcome protocol.Welcome
 
-		writeCh <- incomingMessage
+	defer followContext(ctx, connection.SetDeadline)()
+
+	err := writer.WriteFrame(protocol.Frame{Version: protocol.Version, Type: protocol.FrameHello, Payload: hello.Encode()})
+	if err != nil {
+		return welcome, contextError(ctx, err)
 	}
+
+	response, err := reader.ReadFrame()
+	if err != nil {
+		return welcome, contextError(ctx, err)
+	}
+	if response.Type == protocol.FrameError {
+		return welcome, decodeErrorFrame(response)
+	}
+	if response.Type != protocol.FrameWelcome {
+		return welcome, fmt.Errorf("expected welcome frame, got %s", response.Type)
+	}
+
+	return protocol.DecodeWelcome(response.Payload)
 }
 
-func (client *Client) sendRequestTypeToServer(messageType string) error {
-	messageTypeLength := len(messageType)
-	_, err := client.connection.Write([]byte{byte(messageTypeLength)})
+// log returns the logger of the current connection, or the configured logger
+// before the first connection.
+func (client *Client) log() *slog.Logger {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	if client.connectionLogger == nil {
+		return client.logger
+	}
+	return client.connectionLogger
+}
+
+// negotiatedCodec returns the codec the hub named in the welcome. Hubs that do
+// not name one use the default of the negotiated version.
+func negotiatedCodec(welcome protocol.Welcome, requested protocol.Codec) protocol.Codec {
+	if requested != nil && requested.Name() == welcome.Codec {
+		return requested
+	}
+	if codec, ok := protocol.LookupCodec(welcome.Codec); ok {
+		return codec
+	}
+	codec, _ := protocol.NegotiateCodec(welcome.Version, "")
+	return codec
+}
+
+// currentCodec returns the codec for user ID lists on the current connection.
+func (client *Client) currentCodec() protocol.Codec {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	if client.codec == nil {
+		return protocol.LittleEndian
+	}
+	return client.codec
+}
+
+func (client *Client) request(ctx context.Context, requestType protocol.FrameType, payload []byte, responseType protocol.FrameType) (protocol.Frame, error) {
+	call, err := client.call(ctx, requestType, payload)
 	if err != nil {
-		return err
+		return protocol.Frame{}, err
+	}
+	defer call.finish()
+
+	return call.wait(ctx, responseType)
+}
+
+// pendingCall is a request written to the hub whose response has not been
+// read yet.
+type pendingCall struct {
+	client      *Client
+	requestType protocol.FrameType
+	requestID   uint32
+	responseCh  chan protocol.Frame
+	done        <-chan struct{}
+}
+
+// call writes the request, unless ctx is done first. The caller must call
+// finish on the returned call once it no longer waits for the response.
+func (client *Client) call(ctx context.Context, requestType protocol.FrameType, payload []byte) (*pendingCall, error) {
+	call := &pendingCall{
+		client:      client,
+		requestType: requestType,
+		requestID:   atomic.AddUint32(&client.nextRequestID, 1),
+		responseCh:  make(chan protocol.Frame, 1),
+	}
+
+	client.mutex.RLock()
+	connection, writer, version, done, goingAway := client.connection, client.writer, client.version, client.done, client.goingAway
+	client.mutex.RUnlock()
+	if connection == nil {
+		return nil, ErrNotConnected
+	}
+	if goingAway {
+		return nil, ErrServerGoingAway
 	}
+	call.done = done
 
-	_, err = client.connection.Write([]byte(messageType))
+	client.pendingMutex.Lock()
+	client.pending[call.requestID] = call.responseCh
+	client.pendingMutex.Unlock()
+
+	err := client.write(ctx, connection, writer, protocol.Frame{Version: version, Type: requestType, RequestID: call.requestID, Payload: payload})
 	if err != nil {
-		return err
+		call.finish()
+		return nil, err
 	}
+	return call, nil
+}
 
-	return nil
+// wait waits for the response to the call until ctx is done.
+func (call *pendingCall) wait(ctx context.Context, responseType protocol.FrameType) (protocol.Frame, error) {
+	var response protocol.Frame
+	select {
+	case response = <-call.responseCh:
+	case <-ctx.Done():
+		return protocol.Frame{}, ctx.Err()
+	case <-call.done:
+		select {
+		case response = <-call.responseCh:
+		default:
+			return protocol.Frame{}, call.client.readError()
+		}
+	}
+
+	if response.Type == protocol.FrameError {
+		return response, decodeErrorFrame(response)
+	}
+	if response.Type != responseType {
+		return response, fmt.Errorf("unexpected %s response to `%s` request", response.Type, call.requestType)
+	}
+
+	return response, nil
+}
+
+// finish stops routing the response to the call.
+func (call *pendingCall) finish() {
+	call.client.pendingMutex.Lock()
+	delete(call.client.pending, call.requestID)
+	call.client.pendingMutex.Unlock()
+}
+
+func (client *Client) send(ctx context.Context, requestType protocol.FrameType, payload []byte) error {
+	requestID := atomic.AddUint32(&client.nextRequestID, 1)
+
+	client.mutex.RLock()
+	connection, writer, version, goingAway := client.connection, client.writer, client.version, client.goingAway
+	client.mutex.RUnlock()
+	if connection == nil {
+		return ErrNotConnected
+	}
+	if goingAway {
+		return ErrServerGoingAway
+	}
+
+	return client.write(ctx, connection, writer, protocol.Frame{Version: version, Type: requestType, RequestID: requestID, Payload: payload})
+}
+
+// write writes the frame unless ctx is done first, while waiting for another
+// frame's write or while writing. Without a deadline in ctx, the write gives
+// up after writeTimeout. A write cut short may leave part of the frame on the
+// connection, so the connection is closed; Connect again to go on.
+func (client *Client) write(ctx context.Context, connection net.Conn, writer *protocol.Writer, frame protocol.Frame) error {
+	select {
+	case client.writeLock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-client.writeLock }()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, writeTimeout)
+		defer cancel()
+	}
+
+	stop := followContext(ctx, connection.SetWriteDeadline)
+	err := writer.WriteFrame(frame)
+	stop()
+	if err != nil && (ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded)) {
+		err = contextError(ctx, err)
+		client.log().Warn("Closing the connection after an interrupted write", "message_type", frame.Type.String(), "error", err)
+		connection.Close()
+	}
+	return err
+}
+
+// contextError returns the error of ctx for an I/O error caused by ctx being
+// done. The deadline of the connection may pass just before ctx notices.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// followContext sets the deadline of ctx with setDeadline and a deadline in
+// the past once ctx is canceled, so that blocked I/O returns. The returned
+// function clears the deadline.
+func followContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	deadline, _ := ctx.Deadline()
+	setDeadline(deadline)
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(aLongTimeAgo)
+		close(interrupted)
+	})
+	return func() {
+		if !stop() {
+			<-interrupted
+		}
+		setDeadline(time.Time{})
+	}
+}
+
+func (client *Client) readError() error {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	if client.readErr != nil {
+		return client.readErr
+	}
+	return ErrNotConnected
+}
+
+func decodeErrorFrame(frame protocol.Frame) error {
+	protocolError, err := protocol.DecodeError(frame.Payload)
+	if err != nil {
+		return err
+	}
+	return protocolError
 }
@@ -2,11 +2,15 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/gob"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"io"
+	"log/slog"
+	"message-delivery-system/internal/protocol"
 	"net"
 	"sync"
 	"testing"
@@ -22,6 +26,22 @@ func (s *ServerTestSuite) SetupSuite() {
 	s.client = New()
 }
 
+// acceptAndWelcome accepts a client connection and answers its `hello` frame.
+func (s *ServerTestSuite) acceptAndWelcome(listener net.Listener, userID uint64) net.Conn {
+	connection, err := listener.Accept()
+	assert.NoError(s.T(), err, "should not return error while accepting client connection")
+
+	hello, err := protocol.ReadFrame(connection)
+	assert.NoError(s.T(), err, "should not return error while reading hello from client")
+	assert.Equal(s.T(), protocol.FrameHello, hello.Type)
+
+	welcome := protocol.Welcome{Version: protocol.Version, UserID: userID}
+	err = protocol.WriteFrame(connection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameWelcome, Payload: welcome.Encode()})
+	assert.NoError(s.T(), err, "should not return error while sending welcome to client")
+
+	return connection
+}
+
 func (s *ServerTestSuite) TestWhoAmIRequest() {
 	serverPort := 9002
 	serverAddr := net.TCPAddr{Port: serverPort}
@@ -32,26 +52,17 @@ func (s *ServerTestSuite) TestWhoAmIRequest() {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	var connection net.Conn
 	go func() {
-		var err2 error
-		connection, err2 = listener.Accept()
-		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
+		connection := s.acceptAndWelcome(listener, expectedUserID)
 
-		messageTypeLengthBuffer := make([]byte, 1)
-		_, err2 = connection.Read(messageTypeLengthBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType length from client")
-
-		messageTypeBuffer := make([]byte, 8)
-		_, err2 = connection.Read(messageTypeBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType from client")
-
-		messageType := string(messageTypeBuffer)
-		assert.Equal(s.T(), "who_am_i", messageType)
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		assert.Equal(s.T(), protocol.FrameWhoAmI, request.Type)
 
 		userIDBytes := make([]byte, 8)
 		binary.LittleEndian.PutUint64(userIDBytes, expectedUserID)
-		_, err2 = connection.Write(userIDBytes)
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameWhoAmIResponse, RequestID: request.RequestID, Payload: userIDBytes}
+		err2 = protocol.WriteFrame(connection, response)
 		assert.NoError(s.T(), err2, "should not return error while sending userID to client")
 		wg.Done()
 	}()
@@ -62,6 +73,7 @@ func (s *ServerTestSuite) TestWhoAmIRequest() {
 	assert.NoError(s.T(), err1, "should not return error while creating client")
 
 	userID, err := s.client.WhoAmI()
+	assert.NoError(s.T(), err, "should not return error while requesting userID")
 	assert.Equal(s.T(), expectedUserID, userID)
 	wg.Wait()
 }
@@ -78,35 +90,18 @@ func (s *ServerTestSuite) TestListClientIDsRequest() {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	var connection net.Conn
 	go func() {
-		var err2 error
-		connection, err2 = listener.Accept()
-		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
-
-		messageTypeLengthBuffer := make([]byte, 1)
-		_, err2 = connection.Read(messageTypeLengthBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType length from client")
-
-		messageTypeLength, err2 := binary.ReadUvarint(bytes.NewBuffer(messageTypeLengthBuffer))
-		assert.NoError(s.T(), err2, "messageType length should not be incorrect from")
-
-		messageTypeBuffer := make([]byte, messageTypeLength)
-		_, err2 = connection.Read(messageTypeBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType from client")
+		connection := s.acceptAndWelcome(listener, 1)
 
-		messageType := string(messageTypeBuffer)
-		assert.Equal(s.T(), "who_is_here", messageType)
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		assert.Equal(s.T(), protocol.FrameWhoIsHere, request.Type)
 
-		var buffer bytes.Buffer
-		gobBuffer := gob.NewEncoder(&buffer)
-		err2 = gobBuffer.Encode(expecteduserIDs)
+		payload, err2 := protocol.EncodeUserIDs(protocol.LittleEndian, expecteduserIDs)
 		assert.NoError(s.T(), err2, "should not return error while encoding userIDs")
 
-		_, err2 = connection.Write([]byte{byte(len(buffer.Bytes()))})
-		assert.NoError(s.T(), err2, "should not return error while sending userIDs length to client")
-
-		_, err2 = connection.Write(buffer.Bytes())
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameWhoIsHereResponse, RequestID: request.RequestID, Payload: payload}
+		err2 = protocol.WriteFrame(connection, response)
 		assert.NoError(s.T(), err2, "should not return error while sending userIDs to client")
 		wg.Done()
 	}()
@@ -117,6 +112,51 @@ func (s *ServerTestSuite) TestListClientIDsRequest() {
 	assert.NoError(s.T(), err1, "should not return error while creating client")
 
 	userIDs, err := s.client.ListClientIDs()
+	assert.NoError(s.T(), err, "should not return error while listing userIDs")
+	assert.ElementsMatch(s.T(), expecteduserIDs, userIDs)
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestListClientIDsWithCodec() {
+	serverPort := 9022
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+
+	expecteduserIDs := []uint64{11765426, 326578899}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection, err2 := listener.Accept()
+		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
+
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading hello from client")
+		hello, err2 := protocol.DecodeHello(request.Payload)
+		assert.NoError(s.T(), err2, "should not return error while decoding hello from client")
+		assert.Equal(s.T(), protocol.Gob.Name(), hello.Codec)
+
+		welcome := protocol.Welcome{Version: protocol.Version, UserID: 1, Codec: hello.Codec}
+		err2 = protocol.WriteFrame(connection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameWelcome, Payload: welcome.Encode()})
+		assert.NoError(s.T(), err2, "should not return error while sending welcome to client")
+
+		request, err2 = protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		payload, err2 := protocol.EncodeUserIDs(protocol.Gob, expecteduserIDs)
+		assert.NoError(s.T(), err2, "should not return error while encoding userIDs")
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameWhoIsHereResponse, RequestID: request.RequestID, Payload: payload}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, response), "should not return error while sending userIDs to client")
+	}()
+
+	cli := New()
+	defer cli.Close()
+	err = cli.Connect(&serverAddr, WithCodec(protocol.Gob))
+	assert.NoError(s.T(), err, "should not return error while creating client")
+
+	userIDs, err := cli.ListClientIDs()
+	assert.NoError(s.T(), err, "should not return error while listing userIDs")
 	assert.ElementsMatch(s.T(), expecteduserIDs, userIDs)
 	wg.Wait()
 }
@@ -134,67 +174,73 @@ func (s *ServerTestSuite) TestSendMsgRequest() {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	var connection net.Conn
 	go func() {
-		var err2 error
-		connection, err2 = listener.Accept()
-		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
+		connection := s.acceptAndWelcome(listener, 1)
 
-		messageTypeLengthBuffer := make([]byte, 1)
-		_, err2 = connection.Read(messageTypeLengthBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType length from client")
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		assert.Equal(s.T(), protocol.FrameRelay, request.Type)
 
-		messageTypeLength, err2 := binary.ReadUvarint(bytes.NewBuffer(messageTypeLengthBuffer))
-		assert.NoError(s.T(), err2, "messageType length should not be incorrect from")
+		receivers, body, err2 := protocol.DecodeRelay(protocol.LittleEndian, request.Payload)
+		assert.NoError(s.T(), err2, "should not return error while decoding relay request from client")
 
-		messageTypeBuffer := make([]byte, messageTypeLength)
-		_, err2 = connection.Read(messageTypeBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading messageType from client")
+		assert.ElementsMatch(s.T(), expecteduserIDs, receivers)
+		assert.Equal(s.T(), expectedMessage, string(body))
+		wg.Done()
+	}()
 
-		messageType := string(messageTypeBuffer)
-		assert.Equal(s.T(), "relay", messageType)
+	time.Sleep(1 * time.Second)
 
-		receiverListLengthBuffer := make([]byte, 1)
-		_, err2 = connection.Read(receiverListLengthBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading receivers length from client")
+	err1 := s.client.Connect(&serverAddr)
+	assert.NoError(s.T(), err1, "should not return error while creating client")
 
-		receiverListLength, err2 := binary.ReadUvarint(bytes.NewBuffer(receiverListLengthBuffer))
-		assert.NoError(s.T(), err2, "should not get incorrect receivers length from client")
+	err1 = s.client.SendMsg(expecteduserIDs, []byte(expectedMessage))
+	assert.NoError(s.T(), err1, "should not return error while sending message to peer clients")
 
-		receiversBuffer := make([]byte, receiverListLength)
-		_, err2 = connection.Read(receiversBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading receivers from client")
+	wg.Wait()
+}
 
-		var receivers []uint64
-		gobBuffer := gob.NewDecoder(bytes.NewBuffer(receiversBuffer))
-		err2 = gobBuffer.Decode(&receivers)
-		assert.NoError(s.T(), err2, "should not return error while decoding receivers from client")
+func (s *ServerTestSuite) TestSendMsgWithReceipt() {
+	serverPort := 9008
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
 
-		assert.ElementsMatch(s.T(), expecteduserIDs, receivers)
+	expectedStatus := protocol.RelayStatus{Delivered: []uint64{11}, Offline: []uint64{22}, Failed: []uint64{33}}
 
-		messageLengthBuffer := make([]byte, 4)
-		_, err2 = connection.Read(messageLengthBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading message length from client")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		connection := s.acceptAndWelcome(listener, 1)
 
-		messageLength, err2 := binary.ReadUvarint(bytes.NewBuffer(messageLengthBuffer))
-		assert.NoError(s.T(), err2, "should not get incorrect message length from client")
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		assert.Equal(s.T(), protocol.FrameRelay, request.Type)
 
-		messageBuffer := make([]byte, messageLength)
-		_, err2 = connection.Read(messageBuffer)
-		assert.NoError(s.T(), err2, "should not return error while reading message from client")
+		payload, err2 := expectedStatus.Encode(protocol.LittleEndian)
+		assert.NoError(s.T(), err2, "should not return error while encoding relay status")
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameRelayStatus, RequestID: request.RequestID, Payload: payload}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, response), "should not return error while sending relay status to client")
 
-		assert.Equal(s.T(), expectedMessage, string(messageBuffer))
+		// Never answer the second relay so the caller's context expires.
+		_, err2 = protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
 		wg.Done()
 	}()
 
-	time.Sleep(1 * time.Second)
+	cli := New()
+	require.NoError(s.T(), cli.Connect(&serverAddr), "should not return error while creating client")
+	defer cli.Close()
 
-	err1 := s.client.Connect(&serverAddr)
-	assert.NoError(s.T(), err1, "should not return error while creating client")
-
-	err1 = s.client.SendMsg(expecteduserIDs, []byte(expectedMessage))
-	assert.NoError(s.T(), err1, "should not return error while sending message to peer clients")
+	report, err := cli.SendMsgWithReceipt(context.Background(), []uint64{11, 22, 33}, []byte("Hello"))
+	assert.NoError(s.T(), err, "should not return error while sending message with receipt")
+	assert.Equal(s.T(), DeliveryReport{Delivered: []uint64{11}, Offline: []uint64{22}, Failed: []uint64{33}}, report)
 
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = cli.SendMsgWithReceipt(ctx, []uint64{11}, []byte("Hello again"))
+	assert.Equal(s.T(), context.DeadlineExceeded, err)
 	wg.Wait()
 }
 
@@ -209,25 +255,11 @@ func (s *ServerTestSuite) TestHandleIncomingMessages() {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	var connection net.Conn
 	go func() {
-		var err2 error
-		connection, err2 = listener.Accept()
-		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
-
-		senderIDBytes := make([]byte, 8)
-		binary.LittleEndian.PutUint64(senderIDBytes, expectedSenderID)
-		_, err2 = connection.Write(senderIDBytes)
-		assert.NoError(s.T(), err2, "should not return error while sending senderID to client")
-
-		var messageLength uint32
-		messageLength = uint32(len(expectedMessage))
-		msgLengthBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(msgLengthBytes, messageLength)
-		_, err = connection.Write(msgLengthBytes)
-		assert.NoError(s.T(), err2, "should not return error while sending message length to client")
+		connection := s.acceptAndWelcome(listener, 1)
 
-		_, err = connection.Write([]byte(expectedMessage))
+		message := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(expectedSenderID, []byte(expectedMessage))}
+		err2 := protocol.WriteFrame(connection, message)
 		assert.NoError(s.T(), err2, "should not return error while sending message to client")
 
 		wg.Done()
@@ -240,7 +272,6 @@ func (s *ServerTestSuite) TestHandleIncomingMessages() {
 
 	writeCh := make(chan IncomingMessage)
 	go s.client.HandleIncomingMessages(writeCh)
-	assert.NoError(s.T(), err1, "should not return error while sending message to peer clients")
 
 	incomingMessage := <-writeCh
 	close(writeCh)
@@ -250,10 +281,523 @@ func (s *ServerTestSuite) TestHandleIncomingMessages() {
 	wg.Wait()
 }
 
+func (s *ServerTestSuite) TestConnectRejectedByServer() {
+	serverPort := 9006
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		connection, err2 := listener.Accept()
+		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
+
+		_, err2 = protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading hello from client")
+
+		protocolError := protocol.Error{Code: protocol.ErrorUnsupportedVersion, Message: "no common version"}
+		err2 = protocol.WriteFrame(connection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameError, Payload: protocolError.Encode()})
+		assert.NoError(s.T(), err2, "should not return error while sending error to client")
+		connection.Close()
+		wg.Done()
+	}()
+
+	err = New().Connect(&serverAddr)
+	require.Error(s.T(), err, "should return error when the server rejects the handshake")
+	assert.Equal(s.T(), protocol.ErrorUnsupportedVersion, err.(*protocol.Error).Code)
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestServerGoingAway() {
+	serverPort := 9009
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	closeConnection := make(chan struct{})
+	go func() {
+		connection := s.acceptAndWelcome(listener, 1)
+		err2 := protocol.WriteFrame(connection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameGoingAway, Payload: protocol.EncodeGoingAway("shutting down")})
+		assert.NoError(s.T(), err2, "should not return error while sending going_away to client")
+		<-closeConnection
+		connection.Close()
+	}()
+
+	client := New()
+	require.NoError(s.T(), client.Connect(&serverAddr))
+	assert.Eventually(s.T(), func() bool {
+		return client.SendMsg([]uint64{2}, []byte("late")) == ErrServerGoingAway
+	}, time.Second, 10*time.Millisecond, "should refuse new requests once the server is going away")
+
+	close(closeConnection)
+	_, err = client.WhoAmI()
+	assert.Equal(s.T(), ErrServerGoingAway, err)
+}
+
+func (s *ServerTestSuite) TestRequestsWhileMessagesFlow() {
+	serverPort := 9007
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	expectedUserID := uint64(998877)
+	expectedUserIDs := []uint64{11, 22}
+	expectedSenderID := uint64(5544)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		connection := s.acceptAndWelcome(listener, expectedUserID)
+
+		var requests []protocol.Frame
+		for i := 0; i < 2; i++ {
+			request, err2 := protocol.ReadFrame(connection)
+			assert.NoError(s.T(), err2, "should not return error while reading request from client")
+			requests = append(requests, request)
+		}
+
+		message := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(expectedSenderID, []byte("interleaved"))}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, message), "should not return error while sending message to client")
+
+		// Answer in reverse order so the client has to correlate by request ID.
+		for i := len(requests) - 1; i >= 0; i-- {
+			request := requests[i]
+			response := protocol.Frame{Version: protocol.Version, RequestID: request.RequestID}
+			switch request.Type {
+			case protocol.FrameWhoAmI:
+				response.Type = protocol.FrameWhoAmIResponse
+				response.Payload = make([]byte, 8)
+				binary.LittleEndian.PutUint64(response.Payload, expectedUserID)
+			case protocol.FrameWhoIsHere:
+				response.Type = protocol.FrameWhoIsHereResponse
+				response.Payload, err = protocol.EncodeUserIDs(protocol.LittleEndian, expectedUserIDs)
+				assert.NoError(s.T(), err, "should not return error while encoding userIDs")
+			}
+			assert.NoError(s.T(), protocol.WriteFrame(connection, response), "should not return error while sending response to client")
+		}
+		wg.Done()
+	}()
+
+	cli := New()
+	require.NoError(s.T(), cli.Connect(&serverAddr), "should not return error while creating client")
+	defer cli.Close()
+
+	var userID uint64
+	var userIDs []uint64
+	var requestsWg sync.WaitGroup
+	requestsWg.Add(2)
+	go func() {
+		var err2 error
+		userID, err2 = cli.WhoAmI()
+		assert.NoError(s.T(), err2, "should not return error while requesting userID")
+		requestsWg.Done()
+	}()
+	go func() {
+		var err2 error
+		userIDs, err2 = cli.ListClientIDs()
+		assert.NoError(s.T(), err2, "should not return error while listing userIDs")
+		requestsWg.Done()
+	}()
+	requestsWg.Wait()
+
+	assert.Equal(s.T(), expectedUserID, userID)
+	assert.ElementsMatch(s.T(), expectedUserIDs, userIDs)
+
+	writeCh := make(chan IncomingMessage)
+	go cli.HandleIncomingMessages(writeCh)
+	incomingMessage := <-writeCh
+	assert.Equal(s.T(), expectedSenderID, incomingMessage.SenderID)
+	assert.Equal(s.T(), "interleaved", string(incomingMessage.Body))
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestLogging() {
+	serverPort := 9028
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection := s.acceptAndWelcome(listener, 42)
+		status := protocol.Frame{Version: protocol.Version, Type: protocol.FrameRelayStatus, RequestID: 7}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, status), "should not return error while sending status to client")
+		message := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, Payload: []byte{1}}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, message), "should not return error while sending message to client")
+		connection.Close()
+	}()
+
+	var logs bytes.Buffer
+	cli := New()
+	err = cli.Connect(&serverAddr, WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))))
+	require.NoError(s.T(), err, "should not return error while creating client")
+	wg.Wait()
+
+	// The reader goroutine logs the malformed message before it sees the
+	// connection close.
+	cli.mutex.RLock()
+	done := cli.done
+	cli.mutex.RUnlock()
+	<-done
+
+	records := map[string]map[string]interface{}{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var record map[string]interface{}
+		require.NoError(s.T(), decoder.Decode(&record))
+		records[record["msg"].(string)] = record
+	}
+
+	malformed, ok := records["Malformed frame"]
+	require.True(s.T(), ok, "should log the malformed message")
+	assert.Equal(s.T(), "ERROR", malformed["level"])
+	assert.Equal(s.T(), protocol.FrameMessage.String(), malformed["message_type"])
+	assert.Equal(s.T(), float64(42), malformed["user_id"])
+	assert.NotNil(s.T(), malformed["connection_id"])
+	assert.Contains(s.T(), records, "Connected to the hub")
+	assert.Contains(s.T(), records, "Disconnected from the hub")
+	assert.NotContains(s.T(), records, "Dropping response to unknown request", "the status of a relay nobody waits for should not be logged")
+}
+
+func (s *ServerTestSuite) TestRequestContextDeadline() {
+	serverPort := 9029
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	expectedUserID := uint64(5647382)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection := s.acceptAndWelcome(listener, expectedUserID)
+		defer connection.Close()
+
+		// Leave the first request unanswered and answer the second.
+		_, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+		payload := make([]byte, 8)
+		binary.LittleEndian.PutUint64(payload, expectedUserID)
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameWhoAmIResponse, RequestID: request.RequestID, Payload: payload}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, response), "should not return error while sending userID to client")
+	}()
+
+	cli := New()
+	defer cli.Close()
+	require.NoError(s.T(), cli.Connect(&serverAddr), "should not return error while creating client")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = cli.WhoAmIContext(ctx)
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+
+	userID, err := cli.WhoAmI()
+	assert.NoError(s.T(), err, "should keep the connection usable after a request timed out")
+	assert.Equal(s.T(), expectedUserID, userID)
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestWriteTimeouts() {
+	serverPort := 9041
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// Welcome the client, then never read from it.
+		accepted <- s.acceptAndWelcome(listener, 42)
+	}()
+
+	defer func(timeout time.Duration) { writeTimeout = timeout }(writeTimeout)
+	writeTimeout = 300 * time.Millisecond
+	cli := New()
+	defer cli.Close()
+	require.NoError(s.T(), cli.Connect(&serverAddr), "should not return error while creating client")
+	defer (<-accepted).Close()
+
+	stuck := make(chan error, 1)
+	go func() { stuck <- cli.SendMsg([]uint64{1}, make([]byte, 8*1024*1024)) }()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = cli.SendMsgContext(ctx, []uint64{1}, []byte("queued"))
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+	assert.Less(s.T(), time.Since(start), 200*time.Millisecond, "should give up waiting for another write at the deadline")
+
+	select {
+	case err = <-stuck:
+		assert.ErrorIs(s.T(), err, context.DeadlineExceeded, "a write without a deadline should time out")
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("a write without a deadline should time out")
+	}
+}
+
+func (s *ServerTestSuite) TestConnectContextDeadline() {
+	serverPort := 9030
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// Accept the connection but never answer the `hello` frame.
+		connection, err2 := listener.Accept()
+		assert.NoError(s.T(), err2, "should not return error while accepting client connection")
+		accepted <- connection
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = New().ConnectContext(ctx, &serverAddr)
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+	assert.Less(s.T(), time.Since(start), time.Second, "should give up at the deadline")
+	(<-accepted).Close()
+}
+
+func (s *ServerTestSuite) TestHeartbeat() {
+	serverPort := 9033
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	assert.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection := s.acceptAndWelcome(listener, 1)
+		defer connection.Close()
+
+		ping := protocol.Frame{Version: protocol.Version, Type: protocol.FramePing, RequestID: 7, Payload: []byte("beat")}
+		assert.NoError(s.T(), protocol.WriteFrame(connection, ping), "should not return error while sending ping to client")
+		// Read the client's answer and pings, but never answer them.
+		var answered bool
+		for {
+			frame, err2 := protocol.ReadFrame(connection)
+			if err2 != nil {
+				break
+			}
+			if frame.Type == protocol.FramePong {
+				assert.Equal(s.T(), ping.RequestID, frame.RequestID)
+				assert.Equal(s.T(), ping.Payload, frame.Payload)
+				answered = true
+			}
+		}
+		assert.True(s.T(), answered, "should answer the hub's ping")
+	}()
+
+	disconnected := make(chan StateChange, 1)
+	cli := New()
+	cli.OnStateChange(func(change StateChange) {
+		if change.State == Disconnected {
+			disconnected <- change
+		}
+	})
+	require.NoError(s.T(), cli.Connect(&serverAddr, WithHeartbeat(50*time.Millisecond, 50*time.Millisecond)), "should not return error while creating client")
+
+	select {
+	case change := <-disconnected:
+		assert.ErrorIs(s.T(), change.Err, ErrHeartbeatTimeout)
+	case <-time.After(time.Second):
+		s.T().Fatal("should close the connection when the hub does not answer pings")
+	}
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestHeartbeatTimeoutStartsAfterThePingIsWritten() {
+	serverPort := 9042
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	require.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection := s.acceptAndWelcome(listener, 1)
+		defer connection.Close()
+
+		// Answer every ping at once.
+		for {
+			frame, err2 := protocol.ReadFrame(connection)
+			if err2 != nil {
+				return
+			}
+			if frame.Type == protocol.FramePing {
+				pong := protocol.Frame{Version: protocol.Version, Type: protocol.FramePong, RequestID: frame.RequestID}
+				if protocol.WriteFrame(connection, pong) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	disconnected := make(chan StateChange, 1)
+	cli := New()
+	cli.OnStateChange(func(change StateChange) {
+		if change.State == Disconnected {
+			disconnected <- change
+		}
+	})
+	require.NoError(s.T(), cli.Connect(&serverAddr, WithHeartbeat(20*time.Millisecond, 50*time.Millisecond)), "should not return error while creating client")
+
+	// A long write of another frame holds up the pings.
+	cli.writeLock <- struct{}{}
+	time.Sleep(200 * time.Millisecond)
+	<-cli.writeLock
+
+	select {
+	case change := <-disconnected:
+		s.T().Fatalf("should keep a connection whose hub answers pings, closed with %v", change.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.NoError(s.T(), cli.Close())
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestConnectEndsThePreviousConnection() {
+	firstAddr, secondAddr := net.TCPAddr{Port: 9043}, net.TCPAddr{Port: 9044}
+	firstListener, err := net.Listen("tcp", firstAddr.String())
+	require.NoError(s.T(), err, "should not return error while creating server")
+	defer firstListener.Close()
+	secondListener, err := net.Listen("tcp", secondAddr.String())
+	require.NoError(s.T(), err, "should not return error while creating server")
+	defer secondListener.Close()
+
+	firstConnection := make(chan net.Conn, 1)
+	go func() { firstConnection <- s.acceptAndWelcome(firstListener, 1) }()
+	var states []ConnectionState
+	var stateMutex sync.Mutex
+	cli := New()
+	cli.OnStateChange(func(change StateChange) {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+		states = append(states, change.State)
+	})
+	require.NoError(s.T(), cli.Connect(&firstAddr), "should not return error while creating client")
+	first := <-firstConnection
+	defer first.Close()
+
+	secondConnection := make(chan net.Conn, 1)
+	go func() { secondConnection <- s.acceptAndWelcome(secondListener, 2) }()
+	require.NoError(s.T(), cli.Connect(&secondAddr, WithSessionToken("")), "should not return error while connecting again")
+	second := <-secondConnection
+	defer second.Close()
+	defer cli.Close()
+
+	// The first connection is closed, so its messages no longer reach the
+	// client.
+	require.NoError(s.T(), first.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = first.Read(make([]byte, 1))
+	assert.ErrorIs(s.T(), err, io.EOF, "the previous connection should be closed")
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	assert.Equal(s.T(), []ConnectionState{Connecting, Connected, Connecting, Disconnected, Connected}, states,
+		"the previous connection should be done before the next one is used")
+}
+
+func (s *ServerTestSuite) TestUnconsumedPushesDoNotStallResponses() {
+	serverPort := 9040
+	serverAddr := net.TCPAddr{Port: serverPort}
+	listener, err := net.Listen("tcp", serverAddr.String())
+	require.NoError(s.T(), err, "should not return error while creating server")
+	defer listener.Close()
+
+	expectedUserID := uint64(4321)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connection := s.acceptAndWelcome(listener, expectedUserID)
+		defer connection.Close()
+
+		request, err2 := protocol.ReadFrame(connection)
+		assert.NoError(s.T(), err2, "should not return error while reading request from client")
+
+		// Nobody consumes the pushes, so the buffers overflow.
+		writer := protocol.NewWriter(connection)
+		for i := 0; i < incomingBufferSize+10; i++ {
+			message := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(1, []byte("flood"))}
+			assert.NoError(s.T(), writer.Buffer(message))
+			joined := protocol.Frame{Version: protocol.Version, Type: protocol.FrameUserJoined, Payload: protocol.EncodeUserID(uint64(i))}
+			assert.NoError(s.T(), writer.Buffer(joined))
+		}
+		response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameWhoAmIResponse, RequestID: request.RequestID, Payload: make([]byte, 8)}
+		binary.LittleEndian.PutUint64(response.Payload, expectedUserID)
+		assert.NoError(s.T(), writer.WriteFrame(response), "should not return error while sending userID to client")
+
+		// Wait for the client to close the connection.
+		protocol.ReadFrame(connection)
+	}()
+
+	cli := New()
+	require.NoError(s.T(), cli.Connect(&serverAddr), "should not return error while creating client")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	userID, err := cli.WhoAmIContext(ctx)
+	require.NoError(s.T(), err, "the response should not wait behind the unconsumed pushes")
+	assert.Equal(s.T(), expectedUserID, userID)
+	assert.Equal(s.T(), uint64(10), cli.DroppedMessages())
+	assert.Equal(s.T(), uint64(10), cli.DroppedPresenceEvents())
+
+	require.NoError(s.T(), cli.Close())
+	wg.Wait()
+}
+
 func (s *ServerTestSuite) TearDownSuite() {
 	require.NoError(s.T(), s.client.Close())
 }
 
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 3}
+	assert.Equal(t, 100*time.Millisecond, backoff.delay(1))
+	assert.Equal(t, 300*time.Millisecond, backoff.delay(2))
+	assert.Equal(t, 900*time.Millisecond, backoff.delay(3))
+	assert.Equal(t, time.Second, backoff.delay(4), "delays should stop growing at MaxDelay")
+
+	assert.Equal(t, DefaultBackoff.InitialDelay, Backoff{}.delay(1), "zero values should take the defaults")
+
+	backoff.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := backoff.delay(1)
+		assert.GreaterOrEqual(t, delay, 50*time.Millisecond)
+		assert.LessOrEqual(t, delay, 150*time.Millisecond)
+	}
+}
+
+func TestHeartbeatTimeoutDefaultsToInterval(t *testing.T) {
+	var options connectOptions
+	WithHeartbeat(time.Second, 0)(&options)
+	assert.Equal(t, heartbeatOptions{interval: time.Second, timeout: time.Second}, options.heartbeat)
+}
+
+func TestPermanentlyRejected(t *testing.T) {
+	assert.True(t, permanentlyRejected(&protocol.Error{Code: protocol.ErrorUnauthorized}))
+	assert.True(t, permanentlyRejected(&protocol.Error{Code: protocol.ErrorUnsupportedVersion}))
+	assert.False(t, permanentlyRejected(&protocol.Error{Code: protocol.ErrorLimitExceeded}), "a full hub may take the client later")
+	assert.False(t, permanentlyRejected(context.DeadlineExceeded))
+}
+
 func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerTestSuite))
 }
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"time"
+)
+
+// ErrHeartbeatTimeout is why the connection ended when the hub did not answer
+// a ping in time.
+var ErrHeartbeatTimeout = errors.New("client: hub did not answer ping")
+
+type heartbeatOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// ping pings the hub every interval until the connection ends, and closes the
+// connection when a ping is not answered within the timeout. The timeout
+// starts once the ping is written, so waiting behind a long write of another
+// frame does not count.
+func (client *Client) ping(connection net.Conn, done <-chan struct{}, heartbeat heartbeatOptions, logger *slog.Logger) {
+	ticker := time.NewTicker(heartbeat.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		call, err := client.call(context.Background(), protocol.FramePing, nil)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeat.timeout)
+		_, err = call.wait(ctx, protocol.FramePong)
+		cancel()
+		call.finish()
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Warn("Hub did not answer ping", "message_type", protocol.FramePing.String(), "timeout", heartbeat.timeout)
+			client.mutex.Lock()
+			if client.connection == connection {
+				client.timedOut = true
+			}
+			client.mutex.Unlock()
+			connection.Close()
+			return
+		}
+	}
+}
+
+// pong answers a `ping` from the hub. It is called in its own goroutine so a
+// blocked write does not hold up the reader.
+func (client *Client) pong(ping protocol.Frame, logger *slog.Logger) {
+	client.mutex.RLock()
+	connection, writer, version := client.connection, client.writer, client.version
+	client.mutex.RUnlock()
+
+	pong := protocol.Frame{Version: version, Type: protocol.FramePong, RequestID: ping.RequestID, Payload: ping.Payload}
+	err := client.write(context.Background(), connection, writer, pong)
+	if err != nil {
+		logger.Warn("Answering ping failed", "message_type", ping.Type.String(), "error", err)
+	}
+}
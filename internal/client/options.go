@@ -0,0 +1,103 @@
+package client
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"message-delivery-system/internal/protocol"
+	"time"
+)
+
+type connectOptions struct {
+	sessionToken string
+	credentials  []byte
+	tlsConfig    *tls.Config
+	codec        protocol.Codec
+	// webSocketPath is set when connecting over WebSocket.
+	webSocketPath string
+	logger        *slog.Logger
+	backoff       *Backoff
+	heartbeat     heartbeatOptions
+}
+
+// ConnectOption configures Connect.
+type ConnectOption func(options *connectOptions)
+
+// WithSessionToken resumes the session identified by the token, for example
+// one saved by another process, instead of the session of the last connection.
+func WithSessionToken(sessionToken string) ConnectOption {
+	return func(options *connectOptions) {
+		options.sessionToken = sessionToken
+	}
+}
+
+// WithCredentials presents credentials to the hub's authenticator, such as a
+// shared secret or a token from auth.SignHMACToken. They are kept for later
+// calls to Connect.
+func WithCredentials(credentials []byte) ConnectOption {
+	return func(options *connectOptions) {
+		options.credentials = credentials
+	}
+}
+
+// WithTLSConfig connects over TLS. Set Certificates in the config to
+// authenticate with a client certificate against a hub requiring mutual TLS.
+// The config is kept for later calls to Connect.
+func WithTLSConfig(config *tls.Config) ConnectOption {
+	return func(options *connectOptions) {
+		options.tlsConfig = config
+	}
+}
+
+// WithCodec asks the hub to encode user ID lists with the codec instead of
+// the default protocol.LittleEndian. The hub must know a codec of the same
+// name. The codec is kept for later calls to Connect.
+func WithCodec(codec protocol.Codec) ConnectOption {
+	return func(options *connectOptions) {
+		options.codec = codec
+	}
+}
+
+// WithWebSocket connects over WebSocket to the path on the hub's WebSocket
+// listener instead of over TCP. With WithTLSConfig, wss:// is used. The path
+// is kept for later calls to Connect.
+func WithWebSocket(path string) ConnectOption {
+	return func(options *connectOptions) {
+		options.webSocketPath = path
+	}
+}
+
+// WithLogger sets the logger for the client's events, in place of
+// slog.Default(). Events about a connection carry its connection_id and, once
+// welcomed, its user_id; failed requests are logged at Warn and frames the
+// client cannot make sense of at Error. The logger is kept for later calls to
+// Connect.
+func WithLogger(logger *slog.Logger) ConnectOption {
+	return func(options *connectOptions) {
+		options.logger = logger
+	}
+}
+
+// WithReconnect makes the client connect again when the connection is lost,
+// waiting between attempts as set by the backoff. The session is resumed, so
+// the user ID is kept, and topics and presence are subscribed to again.
+// Requests fail while the client is disconnected. The backoff is kept for
+// later calls to Connect.
+func WithReconnect(backoff Backoff) ConnectOption {
+	return func(options *connectOptions) {
+		options.backoff = &backoff
+	}
+}
+
+// WithHeartbeat makes the client send a `ping` frame to the hub every interval
+// and close the connection, with ErrHeartbeatTimeout, when the hub does not
+// answer within the timeout. With WithReconnect the client then connects
+// again. Timeouts of 0 or less take the interval. The interval and timeout are
+// kept for later calls to Connect.
+func WithHeartbeat(interval time.Duration, timeout time.Duration) ConnectOption {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	return func(options *connectOptions) {
+		options.heartbeat = heartbeatOptions{interval: interval, timeout: timeout}
+	}
+}
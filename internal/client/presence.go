@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"message-delivery-system/internal/protocol"
+	"sync/atomic"
+)
+
+type PresenceEventType int
+
+const (
+	UserJoined PresenceEventType = iota + 1
+	UserLeft
+)
+
+// PresenceEvent tells that a user connected to or disconnected from the hub.
+type PresenceEvent struct {
+	Type   PresenceEventType
+	UserID uint64
+}
+
+// SubscribePresence asks the hub to push an event whenever a user joins or
+// leaves. It returns the users connected at the time of the subscription; the
+// events are read with HandlePresenceEvents.
+func (client *Client) SubscribePresence() ([]uint64, error) {
+	return client.SubscribePresenceContext(context.Background())
+}
+
+// SubscribePresenceContext is like SubscribePresence but gives up when ctx is
+// done.
+func (client *Client) SubscribePresenceContext(ctx context.Context) ([]uint64, error) {
+	var userIDs []uint64
+
+	response, err := client.request(ctx, protocol.FrameSubscribePresence, nil, protocol.FrameWhoIsHereResponse)
+	if err != nil {
+		client.log().Warn("Request failed", "message_type", protocol.FrameSubscribePresence.String(), "error", err)
+		return userIDs, err
+	}
+
+	userIDs, err = protocol.DecodeUserIDs(client.currentCodec(), response.Payload)
+	if err != nil {
+		client.log().Error("Malformed response", "message_type", protocol.FrameSubscribePresence.String(), "error", err)
+		return userIDs, err
+	}
+
+	client.mutex.Lock()
+	client.presenceSubscribed = true
+	client.mutex.Unlock()
+
+	return userIDs, nil
+}
+
+func (client *Client) UnsubscribePresence() error {
+	return client.UnsubscribePresenceContext(context.Background())
+}
+
+// UnsubscribePresenceContext is like UnsubscribePresence but gives up when ctx
+// is done.
+func (client *Client) UnsubscribePresenceContext(ctx context.Context) error {
+	_, err := client.request(ctx, protocol.FrameUnsubscribePresence, nil, protocol.FrameAck)
+	if err != nil {
+		client.log().Warn("Request failed", "message_type", protocol.FrameUnsubscribePresence.String(), "error", err)
+		return err
+	}
+
+	client.mutex.Lock()
+	client.presenceSubscribed = false
+	client.mutex.Unlock()
+
+	return nil
+}
+
+// DroppedPresenceEvents returns how many presence events were dropped because
+// incomingBufferSize of them were waiting for HandlePresenceEvents.
+func (client *Client) DroppedPresenceEvents() uint64 {
+	return atomic.LoadUint64(&client.droppedPresenceEvents)
+}
+
+// HandlePresenceEvents forwards presence events to writeCh until the
+// connection is closed, or like HandleIncomingMessages until reconnecting
+// ends. Like relayed messages, events are buffered while nobody consumes them,
+// and dropped once the buffer is full.
+func (client *Client) HandlePresenceEvents(writeCh chan<- PresenceEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			client.log().Error("Recovered from writing to a closed presence events channel", "panic", r)
+			return
+		}
+	}()
+
+	client.mutex.RLock()
+	stream := client.stream
+	client.mutex.RUnlock()
+	if stream == nil {
+		return
+	}
+	done := stream.done
+
+	for {
+		select {
+		case event := <-client.presence:
+			writeCh <- event
+		case <-done:
+			for {
+				select {
+				case event := <-client.presence:
+					writeCh <- event
+				default:
+					return
+				}
+			}
+		}
+	}
+}
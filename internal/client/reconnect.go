@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"time"
+)
+
+// Backoff sets the delays between attempts to reconnect: the first attempt
+// waits InitialDelay, each further one Multiplier times longer, up to
+// MaxDelay. Zero values of these three take the value of DefaultBackoff.
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// Jitter spreads each delay randomly by up to this fraction of it either
+	// way, so clients of a restarted hub do not come back all at once.
+	Jitter float64
+	// MaxAttempts is how many attempts are made before giving up, 0 for no
+	// limit.
+	MaxAttempts int
+	// AttemptTimeout bounds each attempt, 0 for no bound.
+	AttemptTimeout time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	InitialDelay:   100 * time.Millisecond,
+	MaxDelay:       30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	AttemptTimeout: 10 * time.Second,
+}
+
+// delay returns how long to wait before the attempt, counted from 1.
+func (backoff Backoff) delay(attempt int) time.Duration {
+	if backoff.InitialDelay <= 0 {
+		backoff.InitialDelay = DefaultBackoff.InitialDelay
+	}
+	if backoff.MaxDelay <= 0 {
+		backoff.MaxDelay = DefaultBackoff.MaxDelay
+	}
+	if backoff.Multiplier <= 0 {
+		backoff.Multiplier = DefaultBackoff.Multiplier
+	}
+
+	delay := float64(backoff.InitialDelay) * math.Pow(backoff.Multiplier, float64(attempt-1))
+	delay = math.Min(delay, float64(backoff.MaxDelay))
+	delay += delay * backoff.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(math.Max(delay, 0))
+}
+
+type ConnectionState int
+
+const (
+	// Connecting is emitted before each attempt to connect.
+	Connecting ConnectionState = iota + 1
+	// Connected is emitted when the hub welcomed the client.
+	Connected
+	// Disconnected is emitted when a connection was lost or an attempt to
+	// connect failed.
+	Disconnected
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+type StateChange struct {
+	State ConnectionState
+	// Attempt counts the attempts to reconnect since the connection was lost,
+	// 0 for Connect.
+	Attempt int
+	Time    time.Time
+	// Err is why the client is disconnected.
+	Err error
+}
+
+// OnStateChange registers a handler called for every change of the
+// connection's state. Handlers are called synchronously from the goroutine
+// connecting or reading the connection and must not block.
+func (client *Client) OnStateChange(handler func(change StateChange)) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	client.stateHandlers = append(client.stateHandlers, handler)
+}
+
+func (client *Client) emit(state ConnectionState, attempt int, err error) {
+	client.stateMutex.RLock()
+	handlers := client.stateHandlers
+	client.stateMutex.RUnlock()
+
+	change := StateChange{State: state, Attempt: attempt, Time: time.Now(), Err: err}
+	for _, handler := range handlers {
+		handler(change)
+	}
+}
+
+// stream follows the connection made by a call to Connect and the ones
+// reconnecting after it. HandleIncomingMessages and HandlePresenceEvents run
+// until it is done.
+type stream struct {
+	// ctx is canceled by Close or by the next call to Connect.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once no connection follows the current one.
+	done chan struct{}
+}
+
+func newStream() *stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stream{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+// reconnect is called when the connection of the stream was lost. With
+// WithReconnect it connects again with growing delays until it succeeds, the
+// stream is canceled, the hub rejects the client for good or the attempts run
+// out.
+func (client *Client) reconnect(serverAddr *net.TCPAddr, options connectOptions, stream *stream, err error) {
+	client.emit(Disconnected, 0, err)
+	if options.backoff == nil || stream.ctx.Err() != nil {
+		close(stream.done)
+		return
+	}
+
+	backoff := *options.backoff
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(backoff.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-stream.ctx.Done():
+			timer.Stop()
+			close(stream.done)
+			return
+		}
+
+		ctx, cancel := stream.ctx, func() {}
+		if backoff.AttemptTimeout > 0 {
+			ctx, cancel = context.WithTimeout(stream.ctx, backoff.AttemptTimeout)
+		}
+		err = client.connect(ctx, serverAddr, options, stream, attempt)
+		cancel()
+		if err == nil {
+			client.resubscribe(stream.ctx)
+			return
+		}
+
+		if stream.ctx.Err() != nil {
+			close(stream.done)
+			return
+		}
+		if permanentlyRejected(err) || (backoff.MaxAttempts > 0 && attempt >= backoff.MaxAttempts) {
+			client.log().Warn("Giving up reconnecting to the hub", "attempts", attempt, "error", err)
+			close(stream.done)
+			return
+		}
+	}
+}
+
+// permanentlyRejected tells whether the hub rejected the client for a reason
+// trying again does not fix. A hub at its connection limit, for one, may take
+// the client on a later attempt.
+func permanentlyRejected(err error) bool {
+	var protocolError *protocol.Error
+	if !errors.As(err, &protocolError) {
+		return false
+	}
+	switch protocolError.Code {
+	case protocol.ErrorUnauthorized, protocol.ErrorUnsupportedVersion, protocol.ErrorUnsupportedCodec, protocol.ErrorUnsupportedProtocol:
+		return true
+	}
+	return false
+}
+
+// resubscribe subscribes again to the topics, and to presence, the client
+// subscribed to on the lost connection. Events while it was lost are missed.
+func (client *Client) resubscribe(ctx context.Context) {
+	client.mutex.RLock()
+	topics := make([]string, 0, len(client.topics))
+	for topic := range client.topics {
+		topics = append(topics, topic)
+	}
+	presence := client.presenceSubscribed
+	client.mutex.RUnlock()
+
+	for _, topic := range topics {
+		// Failures are logged, and the next reconnect tries again.
+		client.SubscribeContext(ctx, topic)
+	}
+	if presence {
+		client.SubscribePresenceContext(ctx)
+	}
+}
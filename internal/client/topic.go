@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"message-delivery-system/internal/protocol"
+)
+
+// Subscribe joins the topic. Messages published to it arrive through
+// HandleIncomingMessages with the Topic set.
+func (client *Client) Subscribe(topic string) error {
+	return client.SubscribeContext(context.Background(), topic)
+}
+
+// SubscribeContext is like Subscribe but gives up when ctx is done.
+func (client *Client) SubscribeContext(ctx context.Context, topic string) error {
+	return client.topicRequest(ctx, protocol.FrameSubscribe, topic)
+}
+
+func (client *Client) Unsubscribe(topic string) error {
+	return client.UnsubscribeContext(context.Background(), topic)
+}
+
+// UnsubscribeContext is like Unsubscribe but gives up when ctx is done.
+func (client *Client) UnsubscribeContext(ctx context.Context, topic string) error {
+	return client.topicRequest(ctx, protocol.FrameUnsubscribe, topic)
+}
+
+func (client *Client) topicRequest(ctx context.Context, requestType protocol.FrameType, topic string) error {
+	payload, err := protocol.EncodeTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.request(ctx, requestType, payload, protocol.FrameAck)
+	if err != nil {
+		client.log().Warn("Request failed", "message_type", requestType.String(), "error", err)
+		return err
+	}
+
+	client.mutex.Lock()
+	if requestType == protocol.FrameSubscribe {
+		client.topics[topic] = struct{}{}
+	} else {
+		delete(client.topics, topic)
+	}
+	client.mutex.Unlock()
+
+	return nil
+}
+
+// TopicMembers lists the users subscribed to the topic.
+func (client *Client) TopicMembers(topic string) ([]uint64, error) {
+	return client.TopicMembersContext(context.Background(), topic)
+}
+
+// TopicMembersContext is like TopicMembers but gives up when ctx is done.
+func (client *Client) TopicMembersContext(ctx context.Context, topic string) ([]uint64, error) {
+	var userIDs []uint64
+
+	payload, err := protocol.EncodeTopic(topic)
+	if err != nil {
+		return userIDs, err
+	}
+
+	response, err := client.request(ctx, protocol.FrameTopicMembers, payload, protocol.FrameWhoIsHereResponse)
+	if err != nil {
+		client.log().Warn("Request failed", "message_type", protocol.FrameTopicMembers.String(), "error", err)
+		return userIDs, err
+	}
+
+	userIDs, err = protocol.DecodeUserIDs(client.currentCodec(), response.Payload)
+	if err != nil {
+		client.log().Error("Malformed response", "message_type", protocol.FrameTopicMembers.String(), "error", err)
+		return userIDs, err
+	}
+
+	return userIDs, nil
+}
+
+// Publish sends a message to the other subscribers of the topic without
+// waiting for the hub's delivery status. The publisher does not need to
+// subscribe to the topic.
+func (client *Client) Publish(topic string, body []byte) error {
+	return client.PublishContext(context.Background(), topic, body)
+}
+
+// PublishContext is like Publish but gives up writing the message when ctx is
+// done.
+func (client *Client) PublishContext(ctx context.Context, topic string, body []byte) error {
+	payload, err := protocol.EncodePublish(topic, body)
+	if err != nil {
+		client.log().Warn("Encoding request failed", "message_type", protocol.FramePublish.String(), "error", err)
+		return err
+	}
+
+	err = client.send(ctx, protocol.FramePublish, payload)
+	if err != nil {
+		client.log().Warn("Request failed", "message_type", protocol.FramePublish.String(), "error", err)
+		return err
+	}
+
+	return nil
+}
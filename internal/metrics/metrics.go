@@ -0,0 +1,218 @@
+// Package metrics keeps counters, gauges and histograms and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are histogram buckets for durations in seconds, from 100µs
+// to 10s.
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value uint64
+}
+
+func (counter *Counter) Inc() {
+	atomic.AddUint64(&counter.value, 1)
+}
+
+func (counter *Counter) Add(n uint64) {
+	atomic.AddUint64(&counter.value, n)
+}
+
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+// CounterVec is a family of counters told apart by the value of one label.
+type CounterVec struct {
+	label    string
+	counters sync.Map
+}
+
+// With returns the counter for the label value, creating it on first use.
+func (vec *CounterVec) With(value string) *Counter {
+	counter, _ := vec.counters.LoadOrStore(value, &Counter{})
+	return counter.(*Counter)
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+	mutex   sync.Mutex
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	write      func(w io.Writer, name string)
+}
+
+// Registry holds named metrics and writes them out in the order they were
+// registered.
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	mutex   sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (registry *Registry) register(name string, help string, metricType string, write func(w io.Writer, name string)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.names[name] {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	registry.names[name] = true
+	registry.metrics = append(registry.metrics, metric{name: name, help: help, metricType: metricType, write: write})
+}
+
+// NewCounter registers a counter. Registering a name twice panics.
+func (registry *Registry) NewCounter(name string, help string) *Counter {
+	counter := &Counter{}
+	registry.register(name, help, "counter", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, counter.Value())
+	})
+	return counter
+}
+
+// NewCounterVec registers a family of counters with one label.
+func (registry *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	vec := &CounterVec{label: label}
+	registry.register(name, help, "counter", func(w io.Writer, name string) {
+		var values []string
+		vec.counters.Range(func(value, _ interface{}) bool {
+			values = append(values, value.(string))
+			return true
+		})
+		sort.Strings(values)
+		for _, value := range values {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, vec.label, escapeLabelValue(value), vec.With(value).Value())
+		}
+	})
+	return vec
+}
+
+// NewGaugeFunc registers a gauge whose value is read from the function on
+// every scrape.
+func (registry *Registry) NewGaugeFunc(name string, help string, value func() float64) {
+	registry.register(name, help, "gauge", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value()))
+	})
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets,
+// in increasing order.
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry.register(name, help, "histogram", func(w io.Writer, name string) {
+		histogram.mutex.Lock()
+		counts := append([]uint64(nil), histogram.counts...)
+		count, sum := histogram.count, histogram.sum
+		histogram.mutex.Unlock()
+
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+		fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count %d\n", name, count)
+	})
+	return histogram
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.mutex.RLock()
+	metrics := registry.metrics
+	registry.mutex.RUnlock()
+
+	writer := &countingWriter{writer: bufio.NewWriter(w)}
+	for _, metric := range metrics {
+		fmt.Fprintf(writer, "# HELP %s %s\n", metric.name, escapeHelp(metric.help))
+		fmt.Fprintf(writer, "# TYPE %s %s\n", metric.name, metric.metricType)
+		metric.write(writer, metric.name)
+	}
+	if writer.err != nil {
+		return writer.count, writer.err
+	}
+	return writer.count, writer.writer.Flush()
+}
+
+// Handler serves the metrics to Prometheus scrapes.
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// An error here means the scraper went away.
+		registry.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	writer *bufio.Writer
+	count  int64
+	err    error
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	n, err := writer.writer.Write(p)
+	writer.count += int64(n)
+	writer.err = err
+	return n, err
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_events_total", "Events seen.")
+	vec := registry.NewCounterVec("test_requests_total", "Requests by type.", "type")
+	registry.NewGaugeFunc("test_active", "Active things.", func() float64 { return 3 })
+	histogram := registry.NewHistogram("test_fanout", "Recipients per message.", []float64{1, 10})
+
+	counter.Add(2)
+	counter.Inc()
+	vec.With("relay").Inc()
+	vec.With(`who"is`).Add(4)
+	histogram.Observe(1)
+	histogram.Observe(5)
+	histogram.Observe(50)
+
+	var output bytes.Buffer
+	n, err := registry.WriteTo(&output)
+	require.NoError(t, err)
+	assert.Equal(t, int64(output.Len()), n)
+	assert.Equal(t, `# HELP test_events_total Events seen.
+# TYPE test_events_total counter
+test_events_total 3
+# HELP test_requests_total Requests by type.
+# TYPE test_requests_total counter
+test_requests_total{type="relay"} 1
+test_requests_total{type="who\"is"} 4
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 3
+# HELP test_fanout Recipients per message.
+# TYPE test_fanout histogram
+test_fanout_bucket{le="1"} 1
+test_fanout_bucket{le="10"} 2
+test_fanout_bucket{le="+Inf"} 3
+test_fanout_sum 56
+test_fanout_count 3
+`, output.String())
+}
+
+func TestRegisteringANameTwicePanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "")
+	assert.Panics(t, func() { registry.NewCounter("test_total", "") })
+}
+
+func TestHandlerSetsContentType(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "")
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "test_total 0\n")
+}
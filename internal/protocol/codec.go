@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync"
+)
+
+// Codec encodes the lists of user IDs carried in payloads. The codec of a
+// connection is agreed on in the handshake.
+//
+// A codec encodes only the lists of user IDs; it does not encode whole
+// payloads. The rest of every payload (lengths, sender IDs, message bodies,
+// session tokens) keeps the fixed binary layout of the protocol, whatever the
+// codec, and message bodies are opaque bytes the applications encode as they
+// see fit.
+type Codec interface {
+	// Name identifies the codec in `hello` and `welcome` frames.
+	Name() string
+	EncodeUserIDs(userIDs []uint64) ([]byte, error)
+	DecodeUserIDs(data []byte) ([]uint64, error)
+}
+
+var (
+	// LittleEndian encodes user IDs as consecutive 8-byte little-endian
+	// integers. It is the default from protocol version 2 on.
+	LittleEndian Codec = littleEndianCodec{}
+	// Gob encodes user IDs with encoding/gob, as protocol version 1 did.
+	Gob Codec = gobCodec{}
+)
+
+var (
+	codecs      = map[string]Codec{LittleEndian.Name(): LittleEndian, Gob.Name(): Gob}
+	codecsMutex sync.RWMutex
+)
+
+// RegisterCodec makes a codec available to clients asking for it by name,
+// for example one encoding the user ID lists with protobuf or MessagePack.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+func LookupCodec(name string) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// NegotiateCodec picks the codec for a connection speaking the version.
+// Version 1 always uses gob; later versions use the codec named in the
+// `hello`, or LittleEndian when none is named.
+func NegotiateCodec(version byte, name string) (Codec, bool) {
+	if version < 2 {
+		return Gob, true
+	}
+	if name == "" {
+		return LittleEndian, true
+	}
+	return LookupCodec(name)
+}
+
+type littleEndianCodec struct{}
+
+func (littleEndianCodec) Name() string {
+	return "le64"
+}
+
+func (littleEndianCodec) EncodeUserIDs(userIDs []uint64) ([]byte, error) {
+	data := make([]byte, 8*len(userIDs))
+	for i, userID := range userIDs {
+		binary.LittleEndian.PutUint64(data[8*i:], userID)
+	}
+	return data, nil
+}
+
+func (littleEndianCodec) DecodeUserIDs(data []byte) ([]uint64, error) {
+	if len(data)%8 != 0 {
+		return nil, ErrMalformedPayload
+	}
+	var userIDs []uint64
+	for i := 0; i < len(data); i += 8 {
+		userIDs = append(userIDs, binary.LittleEndian.Uint64(data[i:]))
+	}
+	return userIDs, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) EncodeUserIDs(userIDs []uint64) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) DecodeUserIDs(data []byte) ([]uint64, error) {
+	var userIDs []uint64
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&userIDs)
+	return userIDs, err
+}
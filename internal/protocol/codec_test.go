@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLittleEndianCodec(t *testing.T) {
+	data, err := LittleEndian.EncodeUserIDs([]uint64{1, 1 << 56})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, data, "IDs should be fixed 8-byte little-endian integers")
+
+	userIDs, err := LittleEndian.DecodeUserIDs(data)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1 << 56}, userIDs)
+
+	_, err = LittleEndian.DecodeUserIDs(data[:7])
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestGobCodec(t *testing.T) {
+	data, err := Gob.EncodeUserIDs([]uint64{1, 1 << 56})
+	require.NoError(t, err)
+
+	userIDs, err := Gob.DecodeUserIDs(data)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1 << 56}, userIDs)
+}
+
+type reversedCodec struct{}
+
+func (reversedCodec) Name() string { return "reversed" }
+
+func (reversedCodec) EncodeUserIDs(userIDs []uint64) ([]byte, error) {
+	reversed := make([]uint64, len(userIDs))
+	for i, userID := range userIDs {
+		reversed[len(userIDs)-1-i] = userID
+	}
+	return LittleEndian.EncodeUserIDs(reversed)
+}
+
+func (reversedCodec) DecodeUserIDs(data []byte) ([]uint64, error) {
+	userIDs, err := LittleEndian.DecodeUserIDs(data)
+	if err != nil {
+		return nil, err
+	}
+	reversed := make([]uint64, len(userIDs))
+	for i, userID := range userIDs {
+		reversed[len(userIDs)-1-i] = userID
+	}
+	return reversed, nil
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	codec, ok := NegotiateCodec(1, "le64")
+	assert.True(t, ok)
+	assert.Equal(t, Gob, codec, "version 1 always uses gob")
+
+	codec, ok = NegotiateCodec(2, "")
+	assert.True(t, ok)
+	assert.Equal(t, LittleEndian, codec)
+
+	_, ok = NegotiateCodec(2, "reversed")
+	assert.False(t, ok)
+
+	RegisterCodec(reversedCodec{})
+	t.Cleanup(func() {
+		codecsMutex.Lock()
+		delete(codecs, reversedCodec{}.Name())
+		codecsMutex.Unlock()
+	})
+	codec, ok = NegotiateCodec(2, "reversed")
+	assert.True(t, ok)
+	payload, err := EncodeUserIDs(codec, []uint64{1, 2, 3})
+	require.NoError(t, err)
+	userIDs, err := DecodeUserIDs(codec, payload)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, userIDs)
+}
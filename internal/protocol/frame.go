@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Version is the newest protocol version spoken by this implementation.
+// Version 2 negotiates the codec for user ID lists in the handshake.
+const Version byte = 2
+
+// MinVersion is the oldest protocol version this implementation can still negotiate.
+const MinVersion byte = 1
+
+// HeaderLength is the size of a frame header:
+// [Magic - 2 bytes][Version - 1 byte][FrameType - 1 byte][RequestID - 4 bytes][PayloadLength - 4 bytes]
+const HeaderLength = 12
+
+// MaxPayloadLength caps the payload a single frame may carry.
+const MaxPayloadLength = 16 * 1024 * 1024
+
+// payloadChunkLength is how much of a payload is allocated at a time, so a
+// header alone does not make the reader allocate a large buffer.
+const payloadChunkLength = 64 * 1024
+
+// Magic prefixes every frame. Legacy clients start with a message type length
+// followed by the message type, so they never produce these two bytes.
+var Magic = [2]byte{'M', 'D'}
+
+var (
+	ErrInvalidMagic  = errors.New("protocol: invalid frame magic")
+	ErrFrameTooLarge = errors.New("protocol: frame payload too large")
+)
+
+type FrameType byte
+
+const (
+	FrameHello FrameType = iota + 1
+	FrameWelcome
+	FrameError
+	FrameWhoAmI
+	FrameWhoAmIResponse
+	FrameWhoIsHere
+	FrameWhoIsHereResponse
+	FrameRelay
+	FrameMessage
+	FrameRelayStatus
+	FrameGoingAway
+	FrameAck
+	FrameSubscribePresence
+	FrameUnsubscribePresence
+	FrameUserJoined
+	FrameUserLeft
+	FrameSubscribe
+	FrameUnsubscribe
+	FramePublish
+	FrameTopicMessage
+	FrameTopicMembers
+	FrameBroadcast
+	FramePing
+	FramePong
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameHello:               "hello",
+	FrameWelcome:             "welcome",
+	FrameError:               "error",
+	FrameWhoAmI:              "who_am_i",
+	FrameWhoAmIResponse:      "who_am_i_response",
+	FrameWhoIsHere:           "who_is_here",
+	FrameWhoIsHereResponse:   "who_is_here_response",
+	FrameRelay:               "relay",
+	FrameMessage:             "message",
+	FrameRelayStatus:         "relay_status",
+	FrameGoingAway:           "going_away",
+	FrameAck:                 "ack",
+	FrameSubscribePresence:   "subscribe_presence",
+	FrameUnsubscribePresence: "unsubscribe_presence",
+	FrameUserJoined:          "user_joined",
+	FrameUserLeft:            "user_left",
+	FrameSubscribe:           "subscribe",
+	FrameUnsubscribe:         "unsubscribe",
+	FramePublish:             "publish",
+	FrameTopicMessage:        "topic_message",
+	FrameTopicMembers:        "topic_members",
+	FrameBroadcast:           "broadcast",
+	FramePing:                "ping",
+	FramePong:                "pong",
+}
+
+func (frameType FrameType) String() string {
+	if name, ok := frameTypeNames[frameType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(frameType))
+}
+
+type Frame struct {
+	Version   byte
+	Type      FrameType
+	RequestID uint32
+	Payload   []byte
+}
+
+// WriteFrame encodes the frame and writes it with a single Write call.
+func WriteFrame(w io.Writer, frame Frame) error {
+	if len(frame.Payload) > MaxPayloadLength {
+		return ErrFrameTooLarge
+	}
+
+	buffer := make([]byte, HeaderLength+len(frame.Payload))
+	buffer[0] = Magic[0]
+	buffer[1] = Magic[1]
+	buffer[2] = frame.Version
+	buffer[3] = byte(frame.Type)
+	binary.LittleEndian.PutUint32(buffer[4:8], frame.RequestID)
+	binary.LittleEndian.PutUint32(buffer[8:12], uint32(len(frame.Payload)))
+	copy(buffer[HeaderLength:], frame.Payload)
+
+	_, err := w.Write(buffer)
+	return err
+}
+
+// ReadFrame reads one complete frame. The magic is read and checked before the
+// rest of the header, so a legacy client that only sent a short request is
+// detected without waiting for a full header. An oversized frame is returned
+// without payload together with ErrFrameTooLarge. Its payload is left unread,
+// so the stream cannot be read any further.
+func ReadFrame(r io.Reader) (Frame, error) {
+	return readFrame(r, MaxPayloadLength)
+}
+
+// readFrame reads a frame whose payload may be up to maxPayloadLength bytes.
+func readFrame(r io.Reader, maxPayloadLength uint32) (Frame, error) {
+	var frame Frame
+
+	magicBuffer := make([]byte, 2)
+	_, err := io.ReadFull(r, magicBuffer)
+	if err != nil {
+		return frame, err
+	}
+	if magicBuffer[0] != Magic[0] || magicBuffer[1] != Magic[1] {
+		return frame, ErrInvalidMagic
+	}
+
+	headerBuffer := make([]byte, HeaderLength-2)
+	_, err = io.ReadFull(r, headerBuffer)
+	if err != nil {
+		return frame, err
+	}
+	frame.Version = headerBuffer[0]
+	frame.Type = FrameType(headerBuffer[1])
+	frame.RequestID = binary.LittleEndian.Uint32(headerBuffer[2:6])
+	payloadLength := binary.LittleEndian.Uint32(headerBuffer[6:10])
+	if payloadLength > maxPayloadLength {
+		return frame, ErrFrameTooLarge
+	}
+
+	frame.Payload, err = readPayload(r, int(payloadLength))
+	if err != nil {
+		return frame, err
+	}
+
+	return frame, nil
+}
+
+// readPayload reads length bytes, growing the buffer as they arrive.
+func readPayload(r io.Reader, length int) ([]byte, error) {
+	payload := make([]byte, 0, min(length, payloadChunkLength))
+	for len(payload) < length {
+		start := len(payload)
+		payload = slices.Grow(payload, min(length-start, payloadChunkLength))
+		payload = payload[:min(cap(payload), length)]
+		_, err := io.ReadFull(r, payload[start:])
+		if err == io.EOF && start > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	frame := Frame{Version: Version, Type: FrameRelay, RequestID: 42, Payload: []byte("payload")}
+
+	require.NoError(t, WriteFrame(&buffer, frame))
+	assert.Equal(t, HeaderLength+len(frame.Payload), buffer.Len())
+
+	decoded, err := ReadFrame(&buffer)
+	require.NoError(t, err)
+	assert.Equal(t, frame, decoded)
+}
+
+func TestReadFrameRejectsInvalidMagic(t *testing.T) {
+	legacyRequest := append([]byte{byte(len("who_am_i"))}, "who_am_i"...)
+
+	_, err := ReadFrame(bytes.NewBuffer(legacyRequest))
+	assert.Equal(t, ErrInvalidMagic, err)
+}
+
+func TestReadFrameRejectsOversizedPayload(t *testing.T) {
+	header := make([]byte, HeaderLength)
+	copy(header, Magic[:])
+	header[2] = Version
+	header[3] = byte(FrameRelay)
+	header[4] = 7
+	binary.LittleEndian.PutUint32(header[8:12], MaxPayloadLength+1)
+
+	var buffer bytes.Buffer
+	buffer.Write(header)
+	buffer.Write([]byte("payload"))
+
+	frame, err := ReadFrame(&buffer)
+	assert.Equal(t, ErrFrameTooLarge, err)
+	assert.Equal(t, uint32(7), frame.RequestID)
+
+	// The oversized payload is left unread rather than drained.
+	assert.Equal(t, len("payload"), buffer.Len())
+}
+
+func TestReadFrameTruncatedLargePayload(t *testing.T) {
+	frame := Frame{Version: Version, Type: FrameRelay, RequestID: 1, Payload: make([]byte, 3*payloadChunkLength+10)}
+	var buffer bytes.Buffer
+	require.NoError(t, WriteFrame(&buffer, frame))
+	data := buffer.Bytes()
+
+	decoded, err := ReadFrame(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, frame, decoded)
+
+	for _, length := range []int{HeaderLength + 1, HeaderLength + payloadChunkLength, len(data) - 1} {
+		_, err = ReadFrame(bytes.NewReader(data[:length]))
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated to %d bytes", length)
+	}
+}
+
+func TestFrameTypeString(t *testing.T) {
+	assert.Equal(t, "who_am_i", FrameWhoAmI.String())
+	assert.Equal(t, "relay", FrameRelay.String())
+	assert.Equal(t, "unknown(200)", FrameType(200).String())
+}
@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrMalformedPayload = errors.New("protocol: malformed payload")
+
+// MaxHelloLength caps the payload of a `hello` frame, which hubs read before
+// the client is authenticated.
+const MaxHelloLength = 8 * 1024
+
+// Hello is the first frame a client sends, advertising the range of protocol
+// versions it speaks, the session token it was given when reconnecting, the
+// credentials the hub's authenticator expects and the codec it wants for user
+// ID lists.
+//
+//	[MinVersion - 1 byte][MaxVersion - 1 byte][SessionTokenLength - 2 bytes][SessionToken][CredentialsLength - 2 bytes][Credentials][CodecLength - 2 bytes][Codec]
+type Hello struct {
+	MinVersion   byte
+	MaxVersion   byte
+	SessionToken string
+	Credentials  []byte
+	Codec        string
+}
+
+func (hello Hello) Encode() []byte {
+	payload := []byte{hello.MinVersion, hello.MaxVersion}
+	payload = appendString16(payload, hello.SessionToken)
+	payload = appendString16(payload, string(hello.Credentials))
+	return appendString16(payload, hello.Codec)
+}
+
+func DecodeHello(payload []byte) (Hello, error) {
+	var hello Hello
+	if len(payload) < 2 {
+		return hello, ErrMalformedPayload
+	}
+	hello.MinVersion = payload[0]
+	hello.MaxVersion = payload[1]
+
+	sessionToken, rest, err := decodeString16(payload[2:])
+	if err != nil {
+		return hello, err
+	}
+	hello.SessionToken = sessionToken
+
+	credentials, rest, err := decodeString16(rest)
+	if err != nil {
+		return hello, err
+	}
+	if credentials != "" {
+		hello.Credentials = []byte(credentials)
+	}
+
+	hello.Codec, _, err = decodeString16(rest)
+	return hello, err
+}
+
+// NegotiateVersion picks the newest version supported by both sides.
+func NegotiateVersion(hello Hello) (byte, bool) {
+	version := hello.MaxVersion
+	if version > Version {
+		version = Version
+	}
+	if version < MinVersion || version < hello.MinVersion {
+		return 0, false
+	}
+	return version, true
+}
+
+// Welcome is the server's answer to a successful Hello. Resumed is set when
+// the session token in the Hello was accepted and UserID is the previous one.
+// Codec names the codec used for user ID lists on the connection.
+//
+//	[Version - 1 byte][UserID - 8 bytes][Resumed - 1 byte][SessionTokenLength - 2 bytes][SessionToken][CodecLength - 2 bytes][Codec]
+type Welcome struct {
+	Version      byte
+	UserID       uint64
+	Resumed      bool
+	SessionToken string
+	Codec        string
+}
+
+func (welcome Welcome) Encode() []byte {
+	payload := make([]byte, 10)
+	payload[0] = welcome.Version
+	binary.LittleEndian.PutUint64(payload[1:9], welcome.UserID)
+	if welcome.Resumed {
+		payload[9] = 1
+	}
+	payload = appendString16(payload, welcome.SessionToken)
+	return appendString16(payload, welcome.Codec)
+}
+
+func DecodeWelcome(payload []byte) (Welcome, error) {
+	var welcome Welcome
+	if len(payload) < 10 {
+		return welcome, ErrMalformedPayload
+	}
+	welcome.Version = payload[0]
+	welcome.UserID = binary.LittleEndian.Uint64(payload[1:9])
+	welcome.Resumed = payload[9] == 1
+
+	sessionToken, rest, err := decodeString16(payload[10:])
+	if err != nil {
+		return welcome, err
+	}
+	welcome.SessionToken = sessionToken
+
+	welcome.Codec, _, err = decodeString16(rest)
+	return welcome, err
+}
+
+type ErrorCode uint16
+
+const (
+	ErrorUnsupportedProtocol ErrorCode = iota + 1
+	ErrorUnsupportedVersion
+	ErrorHandshakeRequired
+	ErrorUnknownFrameType
+	ErrorMalformedRequest
+	ErrorLimitExceeded
+	ErrorUnauthorized
+	ErrorUnsupportedCodec
+)
+
+// Error is carried by an error frame and returned to callers as a Go error.
+//
+//	[Code - 2 bytes][MessageLength - 2 bytes][Message]
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("protocol error %d: %s", err.Code, err.Message)
+}
+
+func (err *Error) Encode() []byte {
+	message := err.Message
+	if len(message) > 0xffff {
+		message = message[:0xffff]
+	}
+	payload := make([]byte, 4+len(message))
+	binary.LittleEndian.PutUint16(payload[0:2], uint16(err.Code))
+	binary.LittleEndian.PutUint16(payload[2:4], uint16(len(message)))
+	copy(payload[4:], message)
+	return payload
+}
+
+func DecodeError(payload []byte) (*Error, error) {
+	if len(payload) < 4 {
+		return nil, ErrMalformedPayload
+	}
+	messageLength := int(binary.LittleEndian.Uint16(payload[2:4]))
+	if len(payload) < 4+messageLength {
+		return nil, ErrMalformedPayload
+	}
+	return &Error{
+		Code:    ErrorCode(binary.LittleEndian.Uint16(payload[0:2])),
+		Message: string(payload[4 : 4+messageLength]),
+	}, nil
+}
+
+// EncodeGoingAway encodes the frame the hub sends, with request ID 0, before
+// it shuts down. Requests already sent are still answered; new ones are not.
+//
+//	[ReasonLength - 2 bytes][Reason]
+func EncodeGoingAway(reason string) []byte {
+	return appendString16(nil, reason)
+}
+
+func DecodeGoingAway(payload []byte) (string, error) {
+	reason, _, err := decodeString16(payload)
+	return reason, err
+}
+
+// appendString16 appends a string prefixed with its 2-byte length.
+func appendString16(payload []byte, value string) []byte {
+	if len(value) > 0xffff {
+		value = value[:0xffff]
+	}
+	lengthBytes := make([]byte, 2)
+	binary.LittleEndian.PutUint16(lengthBytes, uint16(len(value)))
+	payload = append(payload, lengthBytes...)
+	return append(payload, value...)
+}
+
+// decodeString16 decodes a string prefixed with its 2-byte length and returns
+// the remainder of the payload. An empty payload decodes to an empty string so
+// optional trailing fields may be omitted.
+func decodeString16(payload []byte) (string, []byte, error) {
+	if len(payload) == 0 {
+		return "", payload, nil
+	}
+	if len(payload) < 2 {
+		return "", nil, ErrMalformedPayload
+	}
+	length := int(binary.LittleEndian.Uint16(payload[0:2]))
+	if len(payload) < 2+length {
+		return "", nil, ErrMalformedPayload
+	}
+	return string(payload[2 : 2+length]), payload[2+length:], nil
+}
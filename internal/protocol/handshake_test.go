@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	version, ok := NegotiateVersion(Hello{MinVersion: MinVersion, MaxVersion: Version + 5})
+	assert.True(t, ok)
+	assert.Equal(t, Version, version)
+
+	_, ok = NegotiateVersion(Hello{MinVersion: Version + 1, MaxVersion: Version + 5})
+	assert.False(t, ok)
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	hello := Hello{MinVersion: 1, MaxVersion: 3, SessionToken: "token", Credentials: []byte("secret"), Codec: "le64"}
+	decodedHello, err := DecodeHello(hello.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, hello, decodedHello)
+
+	decodedHello, err = DecodeHello([]byte{1, 1})
+	require.NoError(t, err, "the session token, credentials and codec are optional")
+	assert.Equal(t, Hello{MinVersion: 1, MaxVersion: 1}, decodedHello)
+
+	welcome := Welcome{Version: 2, UserID: 1234567890123, Resumed: true, SessionToken: "token", Codec: "le64"}
+	decodedWelcome, err := DecodeWelcome(welcome.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, welcome, decodedWelcome)
+
+	_, err = DecodeWelcome([]byte{1, 2, 3})
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	protocolError := &Error{Code: ErrorUnsupportedProtocol, Message: "upgrade the client"}
+
+	decoded, err := DecodeError(protocolError.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, protocolError, decoded)
+	assert.Equal(t, "protocol error 1: upgrade the client", decoded.Error())
+}
+
+func TestGoingAwayRoundTrip(t *testing.T) {
+	reason, err := DecodeGoingAway(EncodeGoingAway("hub shutting down"))
+	require.NoError(t, err)
+	assert.Equal(t, "hub shutting down", reason)
+}
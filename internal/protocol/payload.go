@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxRecipients caps the number of receivers a single `relay` request may name.
+const MaxRecipients = 10000
+
+var ErrTooManyRecipients = errors.New("protocol: too many recipients")
+
+// EncodeUserIDs encodes a `who_is_here` response payload. UserIDs are encoded
+// with the connection's codec.
+//
+//	[UserIDsLength - 4 bytes][UserIDs]
+func EncodeUserIDs(codec Codec, userIDs []uint64) ([]byte, error) {
+	return appendUserIDs(nil, codec, userIDs)
+}
+
+func DecodeUserIDs(codec Codec, payload []byte) ([]uint64, error) {
+	userIDs, _, err := decodeUserIDs(payload, codec)
+	return userIDs, err
+}
+
+// EncodeUserID encodes the payload of `who_am_i` responses and of
+// `user_joined` and `user_left` frames.
+//
+//	[UserID - 8 bytes]
+func EncodeUserID(userID uint64) []byte {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payload, userID)
+	return payload
+}
+
+func DecodeUserID(payload []byte) (uint64, error) {
+	if len(payload) < 8 {
+		return 0, ErrMalformedPayload
+	}
+	return binary.LittleEndian.Uint64(payload), nil
+}
+
+// EncodeRelay encodes a `relay` request payload.
+//
+//	[ReceiverListLength - 4 bytes][Receivers][MessageLength - 4 bytes][Message]
+func EncodeRelay(codec Codec, receivers []uint64, body []byte) ([]byte, error) {
+	if len(receivers) > MaxRecipients {
+		return nil, ErrTooManyRecipients
+	}
+
+	payload, err := appendUserIDs(make([]byte, 0, 4+9*len(receivers)+4+len(body)), codec, receivers)
+	if err != nil {
+		return nil, err
+	}
+	return appendBody(payload, body), nil
+}
+
+func DecodeRelay(codec Codec, payload []byte) ([]uint64, []byte, error) {
+	receivers, rest, err := decodeUserIDs(payload, codec)
+	if err != nil {
+		return receivers, nil, err
+	}
+	if len(receivers) > MaxRecipients {
+		return nil, nil, ErrTooManyRecipients
+	}
+
+	body, err := decodeBody(rest)
+	return receivers, body, err
+}
+
+// EncodeBroadcast encodes a `broadcast` request payload.
+//
+//	[MessageLength - 4 bytes][Message]
+func EncodeBroadcast(body []byte) []byte {
+	return appendBody(nil, body)
+}
+
+func DecodeBroadcast(payload []byte) ([]byte, error) {
+	return decodeBody(payload)
+}
+
+// MaxMessageLength is the largest body a `message` frame can carry; its
+// payload also holds the sender ID and the body length.
+const MaxMessageLength = MaxPayloadLength - 8 - 4
+
+// EncodeMessage encodes a relayed message delivered to a receiver.
+//
+//	[SenderID - 8 bytes][MessageLength - 4 bytes][Message]
+func EncodeMessage(senderID uint64, body []byte) []byte {
+	payload := make([]byte, 8, 8+4+len(body))
+	binary.LittleEndian.PutUint64(payload, senderID)
+	return appendBody(payload, body)
+}
+
+func DecodeMessage(payload []byte) (uint64, []byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, ErrMalformedPayload
+	}
+	senderID := binary.LittleEndian.Uint64(payload[0:8])
+	body, err := decodeBody(payload[8:])
+	return senderID, body, err
+}
+
+// RelayStatus is the hub's per-recipient report for a `relay` request.
+//
+//	[DeliveredLength - 4 bytes][Delivered][OfflineLength - 4 bytes][Offline][FailedLength - 4 bytes][Failed]
+type RelayStatus struct {
+	Delivered []uint64
+	Offline   []uint64
+	Failed    []uint64
+}
+
+func (status RelayStatus) Encode(codec Codec) ([]byte, error) {
+	var payload []byte
+	var err error
+	for _, userIDs := range [][]uint64{status.Delivered, status.Offline, status.Failed} {
+		payload, err = appendUserIDs(payload, codec, userIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func DecodeRelayStatus(codec Codec, payload []byte) (RelayStatus, error) {
+	var status RelayStatus
+	var err error
+	for _, userIDs := range []*[]uint64{&status.Delivered, &status.Offline, &status.Failed} {
+		*userIDs, payload, err = decodeUserIDs(payload, codec)
+		if err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+func appendUserIDs(payload []byte, codec Codec, userIDs []uint64) ([]byte, error) {
+	userIDsBytes, err := codec.EncodeUserIDs(userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDsLengthBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(userIDsLengthBytes, uint32(len(userIDsBytes)))
+	payload = append(payload, userIDsLengthBytes...)
+	return append(payload, userIDsBytes...), nil
+}
+
+// decodeUserIDs decodes a length-prefixed list of user IDs and returns the
+// remainder of the payload.
+func decodeUserIDs(payload []byte, codec Codec) ([]uint64, []byte, error) {
+	var userIDs []uint64
+	if len(payload) < 4 {
+		return userIDs, nil, ErrMalformedPayload
+	}
+	userIDsLength := binary.LittleEndian.Uint32(payload[0:4])
+	if uint64(len(payload)-4) < uint64(userIDsLength) {
+		return userIDs, nil, ErrMalformedPayload
+	}
+
+	userIDs, err := codec.DecodeUserIDs(payload[4 : 4+userIDsLength])
+	if err != nil {
+		return userIDs, nil, err
+	}
+	return userIDs, payload[4+userIDsLength:], nil
+}
+
+func appendBody(payload []byte, body []byte) []byte {
+	messageLengthBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(messageLengthBytes, uint32(len(body)))
+	payload = append(payload, messageLengthBytes...)
+	return append(payload, body...)
+}
+
+func decodeBody(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, ErrMalformedPayload
+	}
+	messageLength := binary.LittleEndian.Uint32(payload[0:4])
+	if uint64(len(payload)-4) < uint64(messageLength) {
+		return nil, ErrMalformedPayload
+	}
+	return payload[4 : 4+messageLength], nil
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRelayRoundTripWithManyRecipients(t *testing.T) {
+	var receivers []uint64
+	for i := uint64(0); i < 5000; i++ {
+		receivers = append(receivers, i<<40|i)
+	}
+	body := []byte("Hello everybody!")
+
+	payload, err := EncodeRelay(LittleEndian, receivers, body)
+	require.NoError(t, err)
+
+	decodedReceivers, decodedBody, err := DecodeRelay(LittleEndian, payload)
+	require.NoError(t, err)
+	assert.Equal(t, receivers, decodedReceivers)
+	assert.Equal(t, body, decodedBody)
+}
+
+func TestRelayRejectsTooManyRecipients(t *testing.T) {
+	receivers := make([]uint64, MaxRecipients+1)
+
+	_, err := EncodeRelay(LittleEndian, receivers, []byte("body"))
+	assert.Equal(t, ErrTooManyRecipients, err)
+
+	payload, err := appendUserIDs(nil, LittleEndian, receivers)
+	require.NoError(t, err)
+	_, _, err = DecodeRelay(LittleEndian, appendBody(payload, []byte("body")))
+	assert.Equal(t, ErrTooManyRecipients, err)
+}
+
+func TestUserIDsRoundTripWithManyUsers(t *testing.T) {
+	var userIDs []uint64
+	for i := uint64(1); i <= 3000; i++ {
+		userIDs = append(userIDs, i*7919)
+	}
+
+	payload, err := EncodeUserIDs(LittleEndian, userIDs)
+	require.NoError(t, err)
+	assert.True(t, len(payload) > 255)
+
+	decoded, err := DecodeUserIDs(LittleEndian, payload)
+	require.NoError(t, err)
+	assert.Equal(t, userIDs, decoded)
+}
+
+func TestDecodeUserIDsRejectsTruncatedPayload(t *testing.T) {
+	payload, err := EncodeUserIDs(LittleEndian, []uint64{1, 2, 3})
+	require.NoError(t, err)
+
+	_, err = DecodeUserIDs(LittleEndian, payload[:len(payload)-1])
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestUserIDRoundTrip(t *testing.T) {
+	userID, err := DecodeUserID(EncodeUserID(1234567890123))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1234567890123), userID)
+
+	_, err = DecodeUserID([]byte{1, 2, 3})
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestBroadcastRoundTrip(t *testing.T) {
+	body, err := DecodeBroadcast(EncodeBroadcast([]byte("everyone")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("everyone"), body)
+
+	_, err = DecodeBroadcast([]byte{5, 0, 0, 0, 'a'})
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	senderID, body, err := DecodeMessage(EncodeMessage(42, []byte("hi")))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), senderID)
+	assert.Equal(t, []byte("hi"), body)
+}
+
+func TestRelayStatusRoundTrip(t *testing.T) {
+	status := RelayStatus{Delivered: []uint64{1, 2}, Offline: []uint64{3}, Failed: nil}
+
+	for _, codec := range []Codec{LittleEndian, Gob} {
+		payload, err := status.Encode(codec)
+		require.NoError(t, err)
+
+		decoded, err := DecodeRelayStatus(codec, payload)
+		require.NoError(t, err, codec.Name())
+		assert.Equal(t, status.Delivered, decoded.Delivered, codec.Name())
+		assert.Equal(t, status.Offline, decoded.Offline, codec.Name())
+		assert.Empty(t, decoded.Failed, codec.Name())
+	}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+const streamBufferSize = 64 * 1024
+
+// Reader reads complete frames from a buffered stream, however the
+// underlying connection fragments them.
+type Reader struct {
+	reader           *bufio.Reader
+	maxPayloadLength uint32
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReaderSize(r, streamBufferSize), maxPayloadLength: MaxPayloadLength}
+}
+
+// SetMaxPayloadLength lowers the payload a frame read from the stream may
+// carry. Lengths out of range restore MaxPayloadLength.
+func (reader *Reader) SetMaxPayloadLength(length int) {
+	if length <= 0 || length > MaxPayloadLength {
+		length = MaxPayloadLength
+	}
+	reader.maxPayloadLength = uint32(length)
+}
+
+// ReadFrame reads the next frame; see the package function ReadFrame. Frames
+// over the reader's payload limit give ErrFrameTooLarge.
+func (reader *Reader) ReadFrame() (Frame, error) {
+	return readFrame(reader.reader, reader.maxPayloadLength)
+}
+
+// Writer writes whole frames through a buffer. It is safe for concurrent use;
+// frames from different goroutines never interleave.
+type Writer struct {
+	writer *bufio.Writer
+	mutex  sync.Mutex
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{writer: bufio.NewWriterSize(w, streamBufferSize)}
+}
+
+// WriteFrame writes the frame and flushes the buffer.
+func (writer *Writer) WriteFrame(frame Frame) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	err := WriteFrame(writer.writer, frame)
+	if err != nil {
+		return err
+	}
+	return writer.writer.Flush()
+}
+
+// Buffer writes the frame without flushing, so several frames can go out in
+// one write. Call Flush afterwards.
+func (writer *Writer) Buffer(frame Frame) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return WriteFrame(writer.writer, frame)
+}
+
+func (writer *Writer) Flush() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.writer.Flush()
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func encodeFrames(t testing.TB, frames ...Frame) []byte {
+	var buffer bytes.Buffer
+	for _, frame := range frames {
+		require.NoError(t, WriteFrame(&buffer, frame))
+	}
+	return buffer.Bytes()
+}
+
+// readAll reads frames until the first error.
+func readAll(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	reader := NewReader(r)
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestReaderFragmentedInput(t *testing.T) {
+	frames := []Frame{
+		{Version: Version, Type: FrameWhoAmI, RequestID: 1, Payload: []byte{}},
+		{Version: Version, Type: FrameRelay, RequestID: 2, Payload: bytes.Repeat([]byte("relay"), 100000)},
+		{Version: Version, Type: FrameMessage, RequestID: 0, Payload: []byte("message")},
+	}
+	data := encodeFrames(t, frames...)
+
+	fragmented := map[string]io.Reader{
+		"one byte":   iotest.OneByteReader(bytes.NewReader(data)),
+		"half":       iotest.HalfReader(bytes.NewReader(data)),
+		"data + EOF": iotest.DataErrReader(bytes.NewReader(data)),
+	}
+	for name, r := range fragmented {
+		decoded, err := readAll(r)
+		assert.Equal(t, io.EOF, err, name)
+		assert.Equal(t, frames, decoded, name)
+	}
+}
+
+func TestReaderTruncatedFrame(t *testing.T) {
+	data := encodeFrames(t, Frame{Version: Version, Type: FrameRelay, RequestID: 1, Payload: []byte("truncated")})
+
+	_, err := readAll(iotest.OneByteReader(bytes.NewReader(data[:len(data)-1])))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderMaxPayloadLength(t *testing.T) {
+	frames := []Frame{
+		{Version: Version, Type: FrameRelay, RequestID: 1, Payload: []byte("fits")},
+		{Version: Version, Type: FrameRelay, RequestID: 2, Payload: []byte("too large")},
+	}
+	reader := NewReader(bytes.NewReader(encodeFrames(t, frames...)))
+	reader.SetMaxPayloadLength(4)
+
+	frame, err := reader.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, frames[0], frame)
+	frame, err = reader.ReadFrame()
+	assert.Equal(t, ErrFrameTooLarge, err)
+	assert.Equal(t, uint32(2), frame.RequestID)
+}
+
+func TestWriterConcurrentFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(requestID uint32) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				frame := Frame{Version: Version, Type: FrameMessage, RequestID: requestID, Payload: bytes.Repeat([]byte{byte(requestID)}, 1000)}
+				if j%2 == 0 {
+					assert.NoError(t, writer.WriteFrame(frame))
+				} else {
+					assert.NoError(t, writer.Buffer(frame))
+				}
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+	require.NoError(t, writer.Flush())
+
+	frames, err := readAll(&buffer)
+	assert.Equal(t, io.EOF, err)
+	require.Len(t, frames, 1000)
+	for _, frame := range frames {
+		assert.Equal(t, bytes.Repeat([]byte{byte(frame.RequestID)}, 1000), frame.Payload)
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add(encodeFrames(f, Frame{Version: Version, Type: FrameWhoAmI, RequestID: 1, Payload: []byte{}}))
+	f.Add(encodeFrames(f,
+		Frame{Version: Version, Type: FrameHello, Payload: Hello{MinVersion: 1, MaxVersion: 1}.Encode()},
+		Frame{Version: Version, Type: FrameMessage, RequestID: 3, Payload: EncodeMessage(7, []byte("body"))},
+	))
+	f.Add([]byte{8, 'w', 'h', 'o', '_', 'a', 'm', '_', 'i'})
+	f.Add([]byte{'M', 'D', 1, 8, 0, 0, 0, 0, 255, 255, 255, 255})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		whole, wholeErr := readAll(bytes.NewReader(data))
+		fragmented, fragmentedErr := readAll(iotest.OneByteReader(bytes.NewReader(data)))
+		assert.Equal(t, wholeErr, fragmentedErr, "fragmentation should not change the outcome")
+		assert.Equal(t, whole, fragmented, "fragmentation should not change the frames")
+
+		// Complete frames encode back to the bytes they were read from.
+		if len(whole) > 0 {
+			encoded := encodeFrames(t, whole...)
+			assert.Equal(t, data[:len(encoded)], encoded)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxTopicLength caps the length of a topic name in bytes.
+const MaxTopicLength = 255
+
+var ErrInvalidTopic = errors.New("protocol: topic must be 1 to 255 bytes long")
+
+func validateTopic(topic string) error {
+	if len(topic) == 0 || len(topic) > MaxTopicLength {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// EncodeTopic encodes the payload of `subscribe`, `unsubscribe` and
+// `topic_members` requests.
+//
+//	[TopicLength - 2 bytes][Topic]
+func EncodeTopic(topic string) ([]byte, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	return appendString16(nil, topic), nil
+}
+
+func DecodeTopic(payload []byte) (string, error) {
+	topic, _, err := decodeString16(payload)
+	if err != nil {
+		return "", err
+	}
+	return topic, validateTopic(topic)
+}
+
+// EncodePublish encodes a `publish` request payload.
+//
+//	[TopicLength - 2 bytes][Topic][MessageLength - 4 bytes][Message]
+func EncodePublish(topic string, body []byte) ([]byte, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	return appendBody(appendString16(nil, topic), body), nil
+}
+
+func DecodePublish(payload []byte) (string, []byte, error) {
+	topic, rest, err := decodeString16(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := validateTopic(topic); err != nil {
+		return "", nil, err
+	}
+	body, err := decodeBody(rest)
+	return topic, body, err
+}
+
+// MaxTopicMessageLength is the largest body a `topic_message` frame for the
+// topic can carry; its payload also holds the topic, the sender ID and the
+// body length.
+func MaxTopicMessageLength(topic string) int {
+	return MaxPayloadLength - 2 - len(topic) - 8 - 4
+}
+
+// EncodeTopicMessage encodes a published message delivered to a subscriber.
+//
+//	[TopicLength - 2 bytes][Topic][SenderID - 8 bytes][MessageLength - 4 bytes][Message]
+func EncodeTopicMessage(topic string, senderID uint64, body []byte) []byte {
+	payload := appendString16(nil, topic)
+	senderIDBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(senderIDBytes, senderID)
+	payload = append(payload, senderIDBytes...)
+	return appendBody(payload, body)
+}
+
+func DecodeTopicMessage(payload []byte) (string, uint64, []byte, error) {
+	topic, rest, err := decodeString16(payload)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(rest) < 8 {
+		return "", 0, nil, ErrMalformedPayload
+	}
+	senderID := binary.LittleEndian.Uint64(rest[0:8])
+	body, err := decodeBody(rest[8:])
+	return topic, senderID, body, err
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestTopicRoundTrip(t *testing.T) {
+	payload, err := EncodeTopic("news")
+	require.NoError(t, err)
+	topic, err := DecodeTopic(payload)
+	require.NoError(t, err)
+	assert.Equal(t, "news", topic)
+
+	_, err = EncodeTopic("")
+	assert.Equal(t, ErrInvalidTopic, err)
+	_, err = EncodeTopic(strings.Repeat("t", MaxTopicLength+1))
+	assert.Equal(t, ErrInvalidTopic, err)
+	_, err = DecodeTopic(nil)
+	assert.Equal(t, ErrInvalidTopic, err)
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	payload, err := EncodePublish("news", []byte("body"))
+	require.NoError(t, err)
+	topic, body, err := DecodePublish(payload)
+	require.NoError(t, err)
+	assert.Equal(t, "news", topic)
+	assert.Equal(t, []byte("body"), body)
+
+	_, _, err = DecodePublish(payload[:len(payload)-1])
+	assert.Equal(t, ErrMalformedPayload, err)
+}
+
+func TestTopicMessageRoundTrip(t *testing.T) {
+	topic, senderID, body, err := DecodeTopicMessage(EncodeTopicMessage("news", 42, []byte("body")))
+	require.NoError(t, err)
+	assert.Equal(t, "news", topic)
+	assert.Equal(t, uint64(42), senderID)
+	assert.Equal(t, []byte("body"), body)
+
+	longest := EncodeTopicMessage("news", 42, make([]byte, MaxTopicMessageLength("news")))
+	assert.Len(t, longest, MaxPayloadLength)
+}
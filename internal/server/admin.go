@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HubSenderID is the sender ID of messages sent by the hub itself through
+// SendMessage.
+const HubSenderID uint64 = 0
+
+// ErrDisconnectedByHub is the reason of the ClientDisconnected event of a
+// client disconnected through Disconnect.
+var ErrDisconnectedByHub = errors.New("server: disconnected by the hub")
+
+// ConnectionStats describes a connected client. User IDs are JSON strings,
+// as JavaScript numbers cannot hold every uint64.
+type ConnectionStats struct {
+	UserID      uint64    `json:"user_id,string"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// QueuedFrames is the number of frames waiting to be written.
+	QueuedFrames   int    `json:"queued_frames"`
+	FramesReceived uint64 `json:"frames_received"`
+	FramesSent     uint64 `json:"frames_sent"`
+	// Dropped counts the relayed messages the user lost, across reconnects.
+	Dropped uint64 `json:"dropped"`
+}
+
+// ConnectionStats returns the stats of every connected client, ordered by
+// user ID.
+func (server *Server) ConnectionStats() []ConnectionStats {
+	stats := []ConnectionStats{}
+
+	server.connections.Range(func(_, value interface{}) bool {
+		stats = append(stats, value.(*connection).stats())
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].UserID < stats[j].UserID })
+	return stats
+}
+
+func (client *connection) stats() ConnectionStats {
+	return ConnectionStats{
+		UserID:         client.userID,
+		RemoteAddr:     client.RemoteAddr().String(),
+		ConnectedAt:    client.connectedAt,
+		QueuedFrames:   client.queued(),
+		FramesReceived: atomic.LoadUint64(&client.framesReceived),
+		FramesSent:     atomic.LoadUint64(&client.framesSent),
+		Dropped:        atomic.LoadUint64(&client.counters.dropped),
+	}
+}
+
+// Disconnect closes the connection of the user. It reports false if the user
+// is not connected. The user's session stays resumable.
+func (server *Server) Disconnect(userID uint64) bool {
+	value, ok := server.connections.Load(userID)
+	if !ok {
+		return false
+	}
+	return server.deregister(value.(*connection), ErrDisconnectedByHub)
+}
+
+// SendMessage relays a message from HubSenderID to the receivers, like a
+// `relay` request from a client.
+func (server *Server) SendMessage(receivers []uint64, body []byte) protocol.RelayStatus {
+	return server.relayMessage(HubSenderID, receivers, body)
+}
+
+// SetAdminToken makes the admin API require the token as a bearer token in
+// the Authorization header. It must be called before StartAdmin.
+func (server *Server) SetAdminToken(token string) {
+	server.adminToken = token
+}
+
+// StartAdmin serves the admin API on laddr, over TLS when a TLS config is set.
+// Without an admin token anyone reaching laddr may disconnect users and send
+// messages, so bind it to a private address.
+func (server *Server) StartAdmin(laddr *net.TCPAddr) error {
+	return server.serveHTTP(laddr, server.AdminHandler(), server.operatorTLSConfig(server.adminTLSConfig))
+}
+
+// SetAdminTLSConfig sets the TLS config of StartAdmin, in place of the one of
+// SetTLSConfig. It must be called before StartAdmin.
+func (server *Server) SetAdminTLSConfig(config *tls.Config) {
+	server.adminTLSConfig = config
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET    /users                 stats of every connected user
+//	GET    /users/{id}            stats of a connected user
+//	DELETE /users/{id}            disconnect the user
+//	POST   /users/{id}/messages   send the request body to the user from HubSenderID
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", server.handleAdminUsers)
+	mux.HandleFunc("/users/", server.handleAdminUser)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.adminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(server.adminToken)) != 1 {
+				writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, server.ConnectionStats())
+}
+
+func (server *Server) handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	userID, err := strconv.ParseUint(path[0], 10, 64)
+	if err != nil || len(path) > 2 || (len(path) == 2 && path[1] != "messages") {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case len(path) == 2 && r.Method == http.MethodPost:
+		server.handleAdminMessage(w, r, userID)
+	case len(path) == 1 && r.Method == http.MethodGet:
+		value, ok := server.connections.Load(userID)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "user is not connected")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, value.(*connection).stats())
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if !server.Disconnect(userID) {
+			writeAdminError(w, http.StatusNotFound, "user is not connected")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (server *Server) handleAdminMessage(w http.ResponseWriter, r *http.Request, userID uint64) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxMessageLength))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeAdminError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("message exceeds %d bytes", protocol.MaxMessageLength))
+			return
+		}
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := server.SendMessage([]uint64{userID}, body)
+	outcome := "delivered"
+	switch {
+	case len(status.Offline) > 0:
+		outcome = "offline"
+	case len(status.Failed) > 0:
+		outcome = "failed"
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"status": outcome})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// An error here means the operator's client went away.
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, message string) {
+	writeAdminJSON(w, code, map[string]string{"error": message})
+}
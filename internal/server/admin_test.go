@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, method string, url string, body string) *http.Response {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	return response
+}
+
+func TestAdminAPI(t *testing.T) {
+	srv := New()
+	srv.SetAdminToken("admin-token")
+	serverAddr := net.TCPAddr{Port: 9025}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+	admin := httptest.NewServer(srv.AdminHandler())
+	defer admin.Close()
+
+	clientConnection, userID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	userURL := admin.URL + "/users/" + strconv.FormatUint(userID, 10)
+
+	response, err := http.Get(admin.URL + "/users")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "requests without the admin token should be rejected")
+
+	response = adminRequest(t, http.MethodGet, admin.URL+"/users", "")
+	var users []ConnectionStats
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&users))
+	response.Body.Close()
+	require.Len(t, users, 1)
+	assert.Equal(t, userID, users[0].UserID)
+	assert.Equal(t, clientConnection.LocalAddr().String(), users[0].RemoteAddr)
+	assert.Equal(t, uint64(1), users[0].FramesSent, "the welcome should be counted")
+
+	response = adminRequest(t, http.MethodPost, userURL+"/messages", "from the operator")
+	var outcome map[string]string
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&outcome))
+	response.Body.Close()
+	assert.Equal(t, "delivered", outcome["status"])
+
+	message, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameMessage, message.Type)
+	senderID, body, err := protocol.DecodeMessage(message.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, HubSenderID, senderID)
+	assert.Equal(t, "from the operator", string(body))
+
+	response = adminRequest(t, http.MethodDelete, userURL, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	_, err = protocol.ReadFrame(clientConnection)
+	assert.Error(t, err, "the disconnected user's connection should be closed")
+	assert.Empty(t, srv.ListClientIDs())
+
+	response = adminRequest(t, http.MethodGet, userURL, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response = adminRequest(t, http.MethodPost, userURL+"/messages", "to nobody")
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&outcome))
+	response.Body.Close()
+	assert.Equal(t, "offline", outcome["status"])
+}
+
+func TestAdminMessageLimits(t *testing.T) {
+	srv := New()
+	srv.SetAdminToken("admin-token")
+	serverAddr := net.TCPAddr{Port: 9038}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+	admin := httptest.NewServer(srv.AdminHandler())
+	defer admin.Close()
+
+	clientConnection, welcome, err := dialWithHello(&serverAddr, protocol.Hello{MinVersion: 1, MaxVersion: 1})
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	userURL := admin.URL + "/users/" + strconv.FormatUint(welcome.UserID, 10)
+
+	response := adminRequest(t, http.MethodPost, userURL+"/messages", strings.Repeat("x", protocol.MaxMessageLength+1))
+	response.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode, "a body that does not fit in a message frame should be rejected")
+
+	response = adminRequest(t, http.MethodPost, userURL+"/messages", "old client")
+	response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	message, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	assert.Equal(t, byte(1), message.Version, "the message should use the recipient's protocol version")
+}
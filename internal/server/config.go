@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"message-delivery-system/internal/auth"
+	"message-delivery-system/internal/utility"
+	"os"
+	"time"
+)
+
+// Config is the configuration of a standalone hub, loaded from a JSON file
+// with LoadConfig. Zero values keep the defaults of New.
+type Config struct {
+	Listen ListenConfig `json:"listen"`
+	TLS    *TLSConfig   `json:"tls"`
+	// AdminTLS and MetricsTLS replace TLS for the admin API and the metrics.
+	// Without them, those use the certificate of TLS and do not ask for
+	// client certificates.
+	AdminTLS     *TLSConfig          `json:"admin_tls"`
+	MetricsTLS   *TLSConfig          `json:"metrics_tls"`
+	Limits       LimitsConfig        `json:"limits"`
+	Timeouts     TimeoutsConfig      `json:"timeouts"`
+	Log          LogConfig           `json:"log"`
+	Store        *StoreConfig        `json:"store"`
+	SlowConsumer *SlowConsumerConfig `json:"slow_consumer"`
+	Auth         *AuthConfig         `json:"auth"`
+	// IDGenerator is how anonymous clients get their user ID: "random", the
+	// default, or "sequential".
+	IDGenerator string `json:"id_generator"`
+	AdminToken  string `json:"admin_token"`
+}
+
+// ListenConfig holds the addresses to listen on, as host:port. The servers
+// left empty are not started.
+type ListenConfig struct {
+	Address   string `json:"address"`
+	WebSocket string `json:"websocket"`
+	Admin     string `json:"admin"`
+	Metrics   string `json:"metrics"`
+}
+
+// TLSConfig holds PEM files. With ClientCAFile set, clients must present a
+// certificate signed by one of its CAs.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+type LimitsConfig struct {
+	MaxConnections    int `json:"max_connections"`
+	MaxMessageSize    int `json:"max_message_size"`
+	OutboundQueueSize int `json:"outbound_queue_size"`
+}
+
+type TimeoutsConfig struct {
+	// Handshake defaults to 10 seconds.
+	Handshake         Duration `json:"handshake"`
+	Idle              Duration `json:"idle"`
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	// HeartbeatTimeout defaults to the heartbeat interval.
+	HeartbeatTimeout   Duration `json:"heartbeat_timeout"`
+	SessionGracePeriod Duration `json:"session_grace_period"`
+	// Shutdown bounds how long the hub waits for requests being handled when
+	// it stops.
+	Shutdown Duration `json:"shutdown"`
+}
+
+// StoreConfig sets up a message store of Type "memory" or "file", the latter
+// keeping its queues in Directory. Zero limits take DefaultStoreLimits.
+type StoreConfig struct {
+	Type      string `json:"type"`
+	Directory string `json:"directory"`
+	// TTL defaults to a day.
+	TTL             Duration `json:"ttl"`
+	MaxPerRecipient int      `json:"max_per_recipient"`
+	MaxTotalBytes   int64    `json:"max_total_bytes"`
+}
+
+// SlowConsumerConfig sets the slow consumer policy. Action is "drop-newest",
+// "drop-oldest", "disconnect" or "block-with-timeout".
+type SlowConsumerConfig struct {
+	Action    string   `json:"action"`
+	Threshold int      `json:"threshold"`
+	Timeout   Duration `json:"timeout"`
+}
+
+// AuthConfig sets up an authenticator of Type "shared_secret" or "hmac",
+// with the secret or key read from SecretFile. A trailing newline in the file
+// is not part of the secret.
+type AuthConfig struct {
+	Type       string `json:"type"`
+	SecretFile string `json:"secret_file"`
+}
+
+// LogConfig sets the level, "debug", "info", "warn" or "error", and the
+// format, "text" or "json", of the logs written to stderr.
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// Duration is a time.Duration written in configuration files as a string
+// such as "30s" or "1m30s".
+type Duration time.Duration
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\", got %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// DefaultConfig listens on port 9000 and waits 10 seconds for requests on
+// shutdown.
+func DefaultConfig() Config {
+	return Config{
+		Listen:   ListenConfig{Address: ":9000"},
+		Timeouts: TimeoutsConfig{Shutdown: Duration(10 * time.Second)},
+	}
+}
+
+// LoadConfig reads the JSON configuration file at path over DefaultConfig.
+// Unknown keys are errors, so a misspelt setting is not ignored.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Options returns the options configuring a server as the config says. The
+// listen addresses are up to the caller.
+func (config Config) Options() ([]Option, error) {
+	logger, err := config.Log.Logger(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	options := []Option{
+		WithLogger(logger),
+		WithMaxConnections(config.Limits.MaxConnections),
+		WithMaxMessageSize(config.Limits.MaxMessageSize),
+		WithIdleTimeout(time.Duration(config.Timeouts.Idle)),
+		WithHandshakeTimeout(time.Duration(config.Timeouts.Handshake)),
+	}
+
+	if config.Limits.OutboundQueueSize > 0 {
+		options = append(options, WithOutboundQueueSize(config.Limits.OutboundQueueSize))
+	}
+	if config.Timeouts.HeartbeatInterval > 0 {
+		options = append(options, WithHeartbeat(time.Duration(config.Timeouts.HeartbeatInterval), time.Duration(config.Timeouts.HeartbeatTimeout)))
+	}
+	if config.Timeouts.SessionGracePeriod > 0 {
+		options = append(options, WithSessionGracePeriod(time.Duration(config.Timeouts.SessionGracePeriod)))
+	}
+	if config.AdminToken != "" {
+		options = append(options, WithAdminToken(config.AdminToken))
+	}
+
+	switch config.IDGenerator {
+	case "", "random":
+	case "sequential":
+		// The IDs start over when the hub restarts, so stored messages would
+		// go to the new users of their recipients' IDs.
+		if config.Store != nil && config.Store.Type == "file" {
+			return nil, errors.New("id_generator sequential cannot be used with a file store")
+		}
+		options = append(options, WithIDGenerator(utility.NewSequentialIDGenerator()))
+	default:
+		return nil, fmt.Errorf("unknown id_generator %q, want random or sequential", config.IDGenerator)
+	}
+
+	for _, listener := range []struct {
+		config *TLSConfig
+		option func(*tls.Config) Option
+	}{
+		{config.TLS, WithTLSConfig},
+		{config.AdminTLS, WithAdminTLSConfig},
+		{config.MetricsTLS, WithMetricsTLSConfig},
+	} {
+		if listener.config == nil {
+			continue
+		}
+		tlsConfig, err := listener.config.Load()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, listener.option(tlsConfig))
+	}
+
+	if config.Store != nil {
+		store, err := config.Store.Open()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithMessageStore(store))
+	}
+	if config.SlowConsumer != nil {
+		policy, err := config.SlowConsumer.Policy()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithSlowConsumerPolicy(policy))
+	}
+	if config.Auth != nil {
+		authenticator, err := config.Auth.Authenticator()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithAuthenticator(authenticator))
+	}
+	return options, nil
+}
+
+// Open creates the message store.
+func (config StoreConfig) Open() (MessageStore, error) {
+	ttl := time.Duration(config.TTL)
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	limits := StoreLimits{MaxPerRecipient: config.MaxPerRecipient, MaxTotalBytes: config.MaxTotalBytes}
+
+	switch config.Type {
+	case "memory":
+		store := NewMemoryStore(ttl)
+		store.SetLimits(limits)
+		return store, nil
+	case "file":
+		if config.Directory == "" {
+			return nil, errors.New("store.directory must be set for a file store")
+		}
+		store, err := NewFileStore(config.Directory, ttl)
+		if err != nil {
+			return nil, err
+		}
+		store.SetLimits(limits)
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown store type %q, want memory or file", config.Type)
+}
+
+// Policy returns the slow consumer policy.
+func (config SlowConsumerConfig) Policy() (SlowConsumerPolicy, error) {
+	policy := SlowConsumerPolicy{Threshold: config.Threshold, Timeout: time.Duration(config.Timeout)}
+	for _, action := range []SlowConsumerAction{DropNewest, DropOldest, Disconnect, BlockWithTimeout} {
+		if config.Action == action.String() {
+			policy.Action = action
+			return policy, nil
+		}
+	}
+	return policy, fmt.Errorf("unknown slow_consumer action %q, want drop-newest, drop-oldest, disconnect or block-with-timeout", config.Action)
+}
+
+// Authenticator creates the authenticator.
+func (config AuthConfig) Authenticator() (auth.Authenticator, error) {
+	secret, err := os.ReadFile(config.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSuffix(bytes.TrimSuffix(secret, []byte("\n")), []byte("\r"))
+	if len(secret) == 0 {
+		return nil, errors.New("no secret in " + config.SecretFile)
+	}
+
+	switch config.Type {
+	case "shared_secret":
+		return auth.NewSharedSecretAuthenticator(secret), nil
+	case "hmac":
+		return auth.NewHMACAuthenticator(secret), nil
+	}
+	return nil, fmt.Errorf("unknown auth type %q, want shared_secret or hmac", config.Type)
+}
+
+// Load reads the certificate, its key and the client CAs.
+func (config TLSConfig) Load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if config.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caPEM, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in " + config.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// Logger returns a logger writing to w.
+func (config LogConfig) Logger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if config.Level != "" {
+		err := level.UnmarshalText([]byte(config.Level))
+		if err != nil {
+			return nil, err
+		}
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	switch config.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, handlerOptions)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOptions)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, want text or json", config.Format)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const jsonConfig = `{
+	"listen": {"address": ":9100", "admin": "127.0.0.1:9101"},
+	"tls": {"cert_file": "hub.pem", "key_file": "hub.key"},
+	"limits": {"max_connections": 100, "max_message_size": 65536},
+	"timeouts": {"idle": "5m", "heartbeat_interval": "30s", "shutdown": "1m30s"},
+	"log": {"level": "debug", "format": "json"},
+	"store": {"type": "file", "directory": "/var/lib/mds", "ttl": "1h"},
+	"slow_consumer": {"action": "drop-oldest", "threshold": 64},
+	"auth": {"type": "hmac", "secret_file": "hmac.key"},
+	"id_generator": "random",
+	"admin_token": "s3cret #1"
+}`
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	expected := Config{
+		Listen:       ListenConfig{Address: ":9100", Admin: "127.0.0.1:9101"},
+		TLS:          &TLSConfig{CertFile: "hub.pem", KeyFile: "hub.key"},
+		Limits:       LimitsConfig{MaxConnections: 100, MaxMessageSize: 65536},
+		Timeouts:     TimeoutsConfig{Idle: Duration(5 * time.Minute), HeartbeatInterval: Duration(30 * time.Second), Shutdown: Duration(90 * time.Second)},
+		Log:          LogConfig{Level: "debug", Format: "json"},
+		Store:        &StoreConfig{Type: "file", Directory: "/var/lib/mds", TTL: Duration(time.Hour)},
+		SlowConsumer: &SlowConsumerConfig{Action: "drop-oldest", Threshold: 64},
+		Auth:         &AuthConfig{Type: "hmac", SecretFile: "hmac.key"},
+		IDGenerator:  "random",
+		AdminToken:   "s3cret #1",
+	}
+
+	config, err := LoadConfig(writeConfig(t, "hub.json", jsonConfig))
+	require.NoError(t, err)
+	assert.Equal(t, expected, config)
+
+	config, err = LoadConfig(writeConfig(t, "empty.json", "{}"))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	invalid := map[string]string{
+		"misspelt.json":   `{"limits": {"max_conections": 1}}`,
+		"duration.json":   `{"timeouts": {"idle": 300}}`,
+		"wrong type.json": `{"limits": {"max_connections": "many"}}`,
+		"truncated.json":  `{"listen": {"address": ":9000"}`,
+		"yaml.yaml":       "listen:\n  address: :9000\n",
+	}
+	for name, content := range invalid {
+		_, err := LoadConfig(writeConfig(t, name, content))
+		assert.Error(t, err, name)
+	}
+
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestConfigOptions(t *testing.T) {
+	config := DefaultConfig()
+	config.Limits = LimitsConfig{MaxConnections: 10, MaxMessageSize: 1024, OutboundQueueSize: 8}
+	config.Timeouts.Idle = Duration(time.Minute)
+	config.Timeouts.HeartbeatInterval = Duration(10 * time.Second)
+	config.IDGenerator = "sequential"
+	config.AdminToken = "token"
+	config.Store = &StoreConfig{Type: "memory", TTL: Duration(time.Hour), MaxPerRecipient: 5}
+	config.SlowConsumer = &SlowConsumerConfig{Action: "block-with-timeout", Threshold: 16, Timeout: Duration(time.Second)}
+	config.Auth = &AuthConfig{Type: "shared_secret", SecretFile: writeConfig(t, "secret", "s3cret\n")}
+	options, err := config.Options()
+	require.NoError(t, err)
+
+	srv := New(options...)
+	assert.Equal(t, 10, srv.maxConnections)
+	assert.Equal(t, 1024, srv.maxMessageSize)
+	assert.Equal(t, 8, srv.queueSize)
+	assert.Equal(t, time.Minute, srv.idleTimeout)
+	assert.Equal(t, 10*time.Second, srv.heartbeatInterval)
+	assert.Equal(t, 10*time.Second, srv.heartbeatTimeout, "the heartbeat timeout should default to the interval")
+	assert.Equal(t, "token", srv.adminToken)
+	assert.Equal(t, []uint64{1, 2}, []uint64{srv.generateID(), srv.generateID()})
+	require.IsType(t, &MemoryStore{}, srv.store)
+	assert.Equal(t, time.Hour, srv.store.(*MemoryStore).TTL())
+	assert.Equal(t, 5, srv.store.(*MemoryStore).limits.MaxPerRecipient)
+	assert.Equal(t, SlowConsumerPolicy{Action: BlockWithTimeout, Threshold: 16, Timeout: time.Second}, srv.slowConsumerPolicy(1))
+	assert.NotNil(t, srv.authenticator)
+
+	for _, invalid := range []Config{
+		{IDGenerator: "uuid"},
+		{Log: LogConfig{Level: "verbose"}},
+		{Log: LogConfig{Format: "xml"}},
+		{TLS: &TLSConfig{CertFile: "missing.pem", KeyFile: "missing.key"}},
+		{AdminTLS: &TLSConfig{CertFile: "missing.pem", KeyFile: "missing.key"}},
+		{Store: &StoreConfig{Type: "redis"}},
+		{Store: &StoreConfig{Type: "file"}},
+		{IDGenerator: "sequential", Store: &StoreConfig{Type: "file", Directory: t.TempDir()}},
+		{SlowConsumer: &SlowConsumerConfig{Action: "ignore"}},
+		{Auth: &AuthConfig{Type: "password", SecretFile: writeConfig(t, "password", "s3cret")}},
+		{Auth: &AuthConfig{Type: "hmac", SecretFile: "missing.key"}},
+		{Auth: &AuthConfig{Type: "hmac", SecretFile: writeConfig(t, "empty", "\n")}},
+	} {
+		_, err := invalid.Options()
+		assert.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	events := make(chan LifecycleEvent, 10)
+	srv := New(WithMaxConnections(1), WithLifecycleHandler(func(event LifecycleEvent) { events <- event }))
+	serverAddr := net.TCPAddr{Port: 9034}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	// A connection that sends no hello does not take a place.
+	silent, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer silent.Close()
+
+	first, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	assert.Equal(t, ClientConnected, receiveEvent(t, events).Type)
+
+	rejected, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	require.NoError(t, writeRequest(rejected, protocol.FrameHello, 0, hello.Encode()))
+	response, err := protocol.ReadFrame(rejected)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ErrorLimitExceeded, protocolError.Code)
+
+	// Once the first client leaves there is room again.
+	first.Close()
+	assert.Equal(t, ClientDisconnected, receiveEvent(t, events).Type)
+	require.Eventually(t, func() bool {
+		second, _, err := dialAndHandshake(&serverAddr)
+		if err != nil {
+			return false
+		}
+		second.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	srv := New(WithMaxMessageSize(8))
+	serverAddr := net.TCPAddr{Port: 9035}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	clientConnection, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+
+	require.NoError(t, writeRequest(clientConnection, protocol.FramePing, 1, []byte("nine byte")))
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Error{Code: protocol.ErrorLimitExceeded, Message: "frame payload exceeds 8 bytes"}, *protocolError)
+
+	// The payload was not read, so the hub closes the connection.
+	_, err = protocol.ReadFrame(clientConnection)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestOperatorTLSConfig(t *testing.T) {
+	hubConfig := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ServerName: "hub"}
+	adminConfig := &tls.Config{ServerName: "admin"}
+	srv := New(WithTLSConfig(hubConfig), WithAdminTLSConfig(adminConfig))
+
+	assert.Same(t, adminConfig, srv.operatorTLSConfig(srv.adminTLSConfig))
+	metricsConfig := srv.operatorTLSConfig(srv.metricsTLSConfig)
+	assert.Equal(t, "hub", metricsConfig.ServerName)
+	assert.Equal(t, tls.NoClientCert, metricsConfig.ClientAuth, "the metrics should not ask for the client certificates of the hub")
+	assert.Equal(t, tls.RequireAndVerifyClientCert, hubConfig.ClientAuth)
+
+	assert.Nil(t, New().operatorTLSConfig(nil))
+}
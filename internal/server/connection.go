@@ -0,0 +1,288 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultOutboundQueueSize = 256
+
+// drainTimeout bounds how long a connection closed by the hub may take to
+// write the frames queued for it.
+const drainTimeout = time.Second
+
+var (
+	errOutboundQueueFull = errors.New("server: outbound queue full")
+	errConnectionClosed  = errors.New("server: connection closed")
+	errSlowConsumer      = errors.New("server: disconnected slow consumer")
+)
+
+// connection is a registered client connection. Frames for the client are
+// queued and written by a dedicated writer goroutine, so every frame is
+// written whole and a slow client does not block the goroutine relaying to it.
+// Frames relayed from other clients wait in outbound, where the slow consumer
+// policy may shed them; the answers to the client's requests and the hub's
+// own frames wait in control, are never shed and are written first.
+type connection struct {
+	net.Conn
+	userID   uint64
+	version  byte
+	codec    protocol.Codec
+	writer   *protocol.Writer
+	outbound chan protocol.Frame
+	control  chan protocol.Frame
+	policy   SlowConsumerPolicy
+	counters *slowConsumerCounters
+	metrics  *serverMetrics
+	logger   *slog.Logger
+	// droppedInRow counts the relayed messages dropped since one was last queued.
+	droppedInRow int64
+	// connectedAt is when the client completed the handshake.
+	connectedAt time.Time
+	// framesReceived and framesSent count the frames read from and written to the client.
+	framesReceived uint64
+	framesSent     uint64
+	// presence is set while the client subscribes to `user_joined` and `user_left` frames.
+	presence int32
+	// closing asks the writer to write the queued frames and close the connection.
+	closing     chan struct{}
+	closingOnce sync.Once
+	// closed is closed once the connection is closed, writerDone once the writer has returned.
+	closed     chan struct{}
+	closedOnce sync.Once
+	writerDone chan struct{}
+}
+
+func newConnection(conn net.Conn, userID uint64, version byte, codec protocol.Codec, queueSize int, policy SlowConsumerPolicy, counters *slowConsumerCounters, metrics *serverMetrics, logger *slog.Logger) *connection {
+	client := &connection{
+		Conn:        conn,
+		userID:      userID,
+		version:     version,
+		codec:       codec,
+		connectedAt: time.Now(),
+		writer:      protocol.NewWriter(conn),
+		outbound:    make(chan protocol.Frame, queueSize),
+		control:     make(chan protocol.Frame, queueSize),
+		policy:      policy,
+		counters:    counters,
+		metrics:     metrics,
+		logger:      logger,
+		closing:     make(chan struct{}),
+		closed:      make(chan struct{}),
+		writerDone:  make(chan struct{}),
+	}
+	go client.writeLoop()
+	return client
+}
+
+// send queues the frame in the control queue, waiting for room in it. It is
+// used for the answers to the client's own requests.
+func (client *connection) send(frame protocol.Frame) error {
+	if len(frame.Payload) > protocol.MaxPayloadLength {
+		return protocol.ErrFrameTooLarge
+	}
+
+	select {
+	case <-client.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	select {
+	case client.control <- frame:
+		return nil
+	case <-client.closed:
+		return errConnectionClosed
+	}
+}
+
+// offer queues the hub's own frame in the control queue without blocking.
+func (client *connection) offer(frame protocol.Frame) error {
+	return client.enqueue(client.control, frame)
+}
+
+// enqueue queues the frame in the queue without blocking.
+func (client *connection) enqueue(queue chan protocol.Frame, frame protocol.Frame) error {
+	if len(frame.Payload) > protocol.MaxPayloadLength {
+		return protocol.ErrFrameTooLarge
+	}
+
+	select {
+	case <-client.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	select {
+	case queue <- frame:
+		return nil
+	default:
+		return errOutboundQueueFull
+	}
+}
+
+// relay queues a message relayed from another client, applying the slow
+// consumer policy when the queue is full.
+func (client *connection) relay(frame protocol.Frame) error {
+	return client.queueRelayed(frame, true)
+}
+
+// notify queues a frame the hub pushes on its own, such as a presence event,
+// applying the slow consumer policy without ever waiting: a BlockWithTimeout
+// policy drops the frame at once when the queue is full.
+func (client *connection) notify(frame protocol.Frame) error {
+	return client.queueRelayed(frame, false)
+}
+
+func (client *connection) queueRelayed(frame protocol.Frame, wait bool) error {
+	err := client.enqueue(client.outbound, frame)
+	if err != errOutboundQueueFull {
+		if err == nil {
+			atomic.StoreInt64(&client.droppedInRow, 0)
+		}
+		return err
+	}
+
+	switch client.policy.Action {
+	case DropOldest:
+		for err == errOutboundQueueFull {
+			select {
+			case <-client.outbound:
+				atomic.AddUint64(&client.counters.dropped, 1)
+			default:
+			}
+			err = client.enqueue(client.outbound, frame)
+		}
+		return err
+	case BlockWithTimeout:
+		if !wait {
+			break
+		}
+		timer := time.NewTimer(client.policy.Timeout)
+		defer timer.Stop()
+		select {
+		case client.outbound <- frame:
+			return nil
+		case <-client.closed:
+			return errConnectionClosed
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddUint64(&client.counters.dropped, 1)
+	if client.policy.Action == Disconnect && atomic.AddInt64(&client.droppedInRow, 1) > int64(client.policy.Threshold) {
+		if closed, _ := client.close(); closed {
+			atomic.AddUint64(&client.counters.disconnects, 1)
+		}
+		return errSlowConsumer
+	}
+	return err
+}
+
+func (client *connection) writeLoop() {
+	defer close(client.writerDone)
+
+	for {
+		select {
+		case frame := <-client.control:
+			if !client.write(frame) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case frame := <-client.control:
+			if !client.write(frame) {
+				return
+			}
+		case frame := <-client.outbound:
+			if !client.write(frame) {
+				return
+			}
+		case <-client.closing:
+			for {
+				frame, ok := client.next()
+				if !ok {
+					client.Close()
+					return
+				}
+				if !client.write(frame) {
+					return
+				}
+			}
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+// next returns a queued frame, control frames first, without blocking.
+func (client *connection) next() (protocol.Frame, bool) {
+	select {
+	case frame := <-client.control:
+		return frame, true
+	default:
+	}
+	select {
+	case frame := <-client.outbound:
+		return frame, true
+	default:
+		return protocol.Frame{}, false
+	}
+}
+
+// queued is the number of frames waiting to be written.
+func (client *connection) queued() int {
+	return len(client.control) + len(client.outbound)
+}
+
+// write buffers the frame and flushes once no more frames are queued, so a
+// burst of frames goes out in few writes.
+func (client *connection) write(frame protocol.Frame) bool {
+	err := client.writer.Buffer(frame)
+	if err == nil {
+		atomic.AddUint64(&client.framesSent, 1)
+		client.metrics.sentBytes.Add(uint64(protocol.HeaderLength + len(frame.Payload)))
+	}
+	if err == nil && client.queued() == 0 {
+		err = client.writer.Flush()
+	}
+	if err != nil {
+		client.metrics.writeErrors.Inc()
+		client.logger.Warn("Writing frame failed", "message_type", frame.Type.String(), "error", err)
+		client.Close()
+		return false
+	}
+	return true
+}
+
+// closeWhenDrained makes the writer close the connection once the queued
+// frames are written.
+func (client *connection) closeWhenDrained() {
+	client.closingOnce.Do(func() { close(client.closing) })
+}
+
+// Close closes the connection right away, dropping the queued frames.
+func (client *connection) Close() error {
+	_, err := client.close()
+	return err
+}
+
+// close reports whether this call is the one that closed the connection.
+func (client *connection) close() (bool, error) {
+	var closed bool
+	var err error
+	client.closedOnce.Do(func() {
+		closed = true
+		close(client.closed)
+		err = client.Conn.Close()
+	})
+	return closed, err
+}
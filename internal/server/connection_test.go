@@ -0,0 +1,77 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"message-delivery-system/internal/metrics"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestConnectionWritesWholeFrames(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	client := newConnection(serverSide, 1, protocol.Version, protocol.LittleEndian, 1000, SlowConsumerPolicy{}, &slowConsumerCounters{}, newServerMetrics(metrics.NewRegistry()), slog.Default())
+	defer client.Close()
+
+	senders, messages := 10, 50
+	var wg sync.WaitGroup
+	for sender := 0; sender < senders; sender++ {
+		wg.Add(1)
+		go func(senderID uint64) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				frame := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(senderID, make([]byte, 1024))}
+				assert.NoError(t, client.send(frame))
+			}
+		}(uint64(sender))
+	}
+
+	for i := 0; i < senders*messages; i++ {
+		frame, err := protocol.ReadFrame(clientSide)
+		require.NoError(t, err, "frames of concurrent senders should not interleave")
+		_, body, err := protocol.DecodeMessage(frame.Payload)
+		require.NoError(t, err)
+		assert.Len(t, body, 1024)
+	}
+	wg.Wait()
+}
+
+func TestConnectionQueueIsBounded(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	client := newConnection(serverSide, 1, protocol.Version, protocol.LittleEndian, 2, SlowConsumerPolicy{}, &slowConsumerCounters{}, newServerMetrics(metrics.NewRegistry()), slog.Default())
+	defer client.Close()
+
+	// Nobody reads from the client side, so at most one frame is being
+	// written and two are queued.
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = client.offer(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage})
+	}
+	assert.Equal(t, errOutboundQueueFull, err, "a stalled client should not block the sender")
+}
+
+func TestConnectionCloseWhenDrained(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	client := newConnection(serverSide, 1, protocol.Version, protocol.LittleEndian, 10, SlowConsumerPolicy{}, &slowConsumerCounters{}, newServerMetrics(metrics.NewRegistry()), slog.Default())
+
+	for i := uint32(1); i <= 3; i++ {
+		require.NoError(t, client.send(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, RequestID: i}))
+	}
+	client.closeWhenDrained()
+
+	for i := uint32(1); i <= 3; i++ {
+		frame, err := protocol.ReadFrame(clientSide)
+		require.NoError(t, err, "queued frames should be written before closing")
+		assert.Equal(t, i, frame.RequestID)
+	}
+	_, err := protocol.ReadFrame(clientSide)
+	assert.Error(t, err)
+	<-client.writerDone
+	assert.Equal(t, errConnectionClosed, client.send(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage}))
+}
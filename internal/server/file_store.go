@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore keeps one append-only queue file per recipient in a directory, so
+// queued messages survive a restart of the hub. Each record is:
+//
+//	[StoredAt - 8 bytes][SenderID - 8 bytes][MessageLength - 4 bytes][Message]
+//
+// A queue file that cannot be read is renamed with a .corrupt suffix and left
+// for inspection; the messages before the damage are still delivered.
+//
+// Sessions are not kept across restarts, so only authenticated users, whose
+// user ID derives from their identity, get the messages queued before a
+// restart. Queues for anonymous users are left to expire with the TTL. A
+// sequential ID generator hands the same IDs out again after a restart, and
+// would deliver those queues to other users, so do not combine it with a
+// FileStore.
+type FileStore struct {
+	directory string
+	ttl       time.Duration
+	limits    StoreLimits
+	// queues holds the size of each queue file and bytes the size of all the
+	// message bodies, for enforcing the limits.
+	queues map[uint64]queueSize
+	bytes  int64
+	mutex  sync.Mutex
+}
+
+type queueSize struct {
+	messages int
+	bytes    int64
+}
+
+func NewFileStore(directory string, ttl time.Duration) (*FileStore, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore{directory: directory, ttl: ttl, limits: DefaultStoreLimits, queues: make(map[uint64]queueSize)}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		recipientID, ok := queueRecipient(entry.Name())
+		if !ok {
+			continue
+		}
+		// Damaged files are quarantined, and the messages before the damage
+		// are kept.
+		queue, err := store.readQueue(recipientID)
+		if err == nil {
+			store.count(recipientID, queue)
+			continue
+		}
+		if len(queue) > 0 {
+			err = store.rewrite(recipientID, queue)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return store, nil
+}
+
+// SetLimits bounds the messages the store keeps.
+func (store *FileStore) SetLimits(limits StoreLimits) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.limits = limits.withDefaults()
+}
+
+func (store *FileStore) TTL() time.Duration {
+	return store.ttl
+}
+
+func (store *FileStore) Store(recipientID uint64, message StoredMessage) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.queues[recipientID].messages >= store.limits.MaxPerRecipient || store.bytes+int64(len(message.Body)) > store.limits.MaxTotalBytes {
+		return ErrStoreFull
+	}
+
+	file, err := os.OpenFile(store.queuePath(recipientID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(encodeRecord(message))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	store.count(recipientID, []StoredMessage{message})
+	return nil
+}
+
+func (store *FileStore) Flush(recipientID uint64) ([]StoredMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	queue, readErr := store.readQueue(recipientID)
+	err := store.remove(recipientID)
+	if err != nil {
+		return nil, err
+	}
+	return unexpired(queue, store.ttl, time.Now()), readErr
+}
+
+// Expire rewrites the queue files holding expired messages without them.
+func (store *FileStore) Expire(now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for recipientID, size := range store.queues {
+		queue, _ := store.readQueue(recipientID)
+		fresh := unexpired(queue, store.ttl, now)
+		if len(fresh) == size.messages {
+			continue
+		}
+
+		// The rewrite replaces the file atomically, so the fresh messages
+		// are not lost when it fails.
+		var err error
+		if len(fresh) == 0 {
+			err = store.remove(recipientID)
+		} else {
+			err = store.rewrite(recipientID, fresh)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the queue file of the recipient, atomically, by one
+// holding the messages. The caller must hold the mutex.
+func (store *FileStore) rewrite(recipientID uint64, queue []StoredMessage) error {
+	var records []byte
+	for _, message := range queue {
+		records = append(records, encodeRecord(message)...)
+	}
+
+	temporaryPath := store.queuePath(recipientID) + ".tmp"
+	err := os.WriteFile(temporaryPath, records, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temporaryPath, store.queuePath(recipientID))
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	store.forget(recipientID)
+	store.count(recipientID, queue)
+	return nil
+}
+
+// count adds the messages to the size of the recipient's queue. The caller
+// must hold the mutex.
+func (store *FileStore) count(recipientID uint64, messages []StoredMessage) {
+	size := store.queues[recipientID]
+	size.messages += len(messages)
+	size.bytes += bodiesLength(messages)
+	store.queues[recipientID] = size
+	store.bytes += bodiesLength(messages)
+}
+
+// forget stops counting the recipient's queue. The caller must hold the
+// mutex.
+func (store *FileStore) forget(recipientID uint64) {
+	store.bytes -= store.queues[recipientID].bytes
+	delete(store.queues, recipientID)
+}
+
+// remove deletes the queue file of the recipient. The caller must hold the
+// mutex.
+func (store *FileStore) remove(recipientID uint64) error {
+	err := os.Remove(store.queuePath(recipientID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	store.forget(recipientID)
+	return nil
+}
+
+// readQueue reads the queue file of the recipient. A file that cannot be read
+// to the end is quarantined, and the messages before the damage are returned
+// with the error. The caller must hold the mutex.
+func (store *FileStore) readQueue(recipientID uint64) ([]StoredMessage, error) {
+	path := store.queuePath(recipientID)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := readQueue(bufio.NewReader(file))
+	file.Close()
+	if err == nil {
+		return queue, nil
+	}
+
+	err = fmt.Errorf("reading message queue %s: %w", path, err)
+	renameErr := os.Rename(path, path+".corrupt")
+	if renameErr != nil {
+		return queue, fmt.Errorf("%w; quarantining it failed: %s", err, renameErr.Error())
+	}
+	// The messages read are counted no more; the caller delivers them or
+	// writes them back.
+	store.forget(recipientID)
+	return queue, err
+}
+
+func (store *FileStore) queuePath(recipientID uint64) string {
+	return filepath.Join(store.directory, fmt.Sprintf("%d.queue", recipientID))
+}
+
+// queueRecipient returns the recipient of the queue file with the name.
+func queueRecipient(name string) (uint64, bool) {
+	idText, ok := strings.CutSuffix(name, ".queue")
+	if !ok {
+		return 0, false
+	}
+	recipientID, err := strconv.ParseUint(idText, 10, 64)
+	return recipientID, err == nil
+}
+
+const recordHeaderLength = 20
+
+func encodeRecord(message StoredMessage) []byte {
+	record := make([]byte, recordHeaderLength, recordHeaderLength+len(message.Body))
+	binary.LittleEndian.PutUint64(record[0:8], uint64(message.StoredAt.UnixNano()))
+	binary.LittleEndian.PutUint64(record[8:16], message.SenderID)
+	binary.LittleEndian.PutUint32(record[16:20], uint32(len(message.Body)))
+	return append(record, message.Body...)
+}
+
+func readQueue(reader io.Reader) ([]StoredMessage, error) {
+	var queue []StoredMessage
+
+	header := make([]byte, recordHeaderLength)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return queue, nil
+		}
+		if err != nil {
+			return queue, err
+		}
+
+		bodyLength := binary.LittleEndian.Uint32(header[16:20])
+		if bodyLength > protocol.MaxPayloadLength {
+			return queue, fmt.Errorf("record of %d bytes", bodyLength)
+		}
+		message := StoredMessage{
+			StoredAt: time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8]))),
+			SenderID: binary.LittleEndian.Uint64(header[8:16]),
+			Body:     make([]byte, bodyLength),
+		}
+		_, err = io.ReadFull(reader, message.Body)
+		if err != nil {
+			return queue, err
+		}
+		queue = append(queue, message)
+	}
+}
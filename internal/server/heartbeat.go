@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	// ErrHeartbeatTimeout is the reason of the ClientDisconnected event of a
+	// client that did not answer the hub's pings.
+	ErrHeartbeatTimeout = errors.New("server: client did not answer ping")
+	// ErrIdleTimeout is the reason of the ClientDisconnected event of a client
+	// that sent nothing but pings and pongs for longer than the idle timeout.
+	ErrIdleTimeout = errors.New("server: client was idle for too long")
+)
+
+// defaultHandshakeTimeout bounds how long a new connection may take to
+// complete the handshake.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// SetHandshakeTimeout bounds how long a new connection may take to send its
+// `hello` and read the answer; connections that take longer are closed. The
+// default is 10 seconds, and timeouts of 0 or less keep it. It must be called
+// before Start.
+func (server *Server) SetHandshakeTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		server.handshakeTimeout = timeout
+	}
+}
+
+// SetHeartbeat makes the hub send a `ping` frame to every client each
+// interval. A client that sends no frame for interval plus timeout, so it did
+// not answer the last ping, is disconnected. Timeouts of 0 or less take the
+// interval. It must be called before Start.
+func (server *Server) SetHeartbeat(interval time.Duration, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	server.heartbeatInterval = interval
+	server.heartbeatTimeout = timeout
+}
+
+// SetIdleTimeout makes the hub disconnect clients that send no frame other
+// than `ping` and `pong` for the timeout, and close connections that do not
+// send a `hello` within it. It must be called before Start.
+func (server *Server) SetIdleTimeout(timeout time.Duration) {
+	server.idleTimeout = timeout
+}
+
+// handshakeDeadline returns how long a new connection has for the handshake:
+// the handshake timeout, or the idle timeout when it is shorter.
+func (server *Server) handshakeDeadline() time.Duration {
+	if server.idleTimeout > 0 && server.idleTimeout < server.handshakeTimeout {
+		return server.idleTimeout
+	}
+	return server.handshakeTimeout
+}
+
+// extendReadDeadline sets the deadline for reading the next frame of the
+// connection. Any frame answers the heartbeat, while only frames other than
+// `ping` and `pong`, the last of which came at lastActivity, keep the client
+// from being idle.
+func (server *Server) extendReadDeadline(conn net.Conn, lastActivity time.Time) {
+	var deadline time.Time
+	if server.heartbeatInterval > 0 {
+		deadline = time.Now().Add(server.heartbeatInterval + server.heartbeatTimeout)
+	}
+	if server.idleTimeout > 0 {
+		idleDeadline := lastActivity.Add(server.idleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	// A zero deadline clears the one of the handshake.
+	conn.SetReadDeadline(deadline)
+}
+
+// timedOut returns why a client whose last frame other than `ping` and `pong`
+// came at lastActivity is disconnected when reading its next frame failed
+// with err.
+func (server *Server) timedOut(err error, lastActivity time.Time) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+
+	if server.idleTimeout > 0 && time.Since(lastActivity) >= server.idleTimeout {
+		server.metrics.timeouts.With("idle").Inc()
+		return ErrIdleTimeout
+	}
+	if server.heartbeatInterval > 0 {
+		server.metrics.timeouts.With("heartbeat").Inc()
+		return ErrHeartbeatTimeout
+	}
+	return err
+}
+
+// isActivity tells whether a frame of the type keeps the client from being
+// idle.
+func isActivity(frameType protocol.FrameType) bool {
+	return frameType != protocol.FramePing && frameType != protocol.FramePong
+}
+
+// heartbeat pings the client every interval until the connection is closed.
+// The pings wait in the outbound queue like other frames; a client that does
+// not read them times out.
+func (client *connection) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var requestID uint32
+	for {
+		select {
+		case <-ticker.C:
+			requestID++
+			ping := protocol.Frame{Version: client.version, Type: protocol.FramePing, RequestID: requestID}
+			err := client.offer(ping)
+			if err != nil {
+				client.logger.Debug("Sending ping failed", "message_type", ping.Type.String(), "error", err)
+			}
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+var handlePingRequest = func(server *Server, client *connection, request protocol.Frame) {
+	err := client.respond(request, protocol.FramePong, request.Payload)
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+// handlePongRequest does nothing: receiving the frame already reset the
+// client's read deadline.
+var handlePongRequest = func(server *Server, client *connection, request protocol.Frame) {}
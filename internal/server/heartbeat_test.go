@@ -0,0 +1,127 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	srv := New()
+	srv.SetHeartbeat(50*time.Millisecond, 50*time.Millisecond)
+	events := make(chan LifecycleEvent, 10)
+	srv.OnLifecycleEvent(func(event LifecycleEvent) { events <- event })
+	serverAddr := net.TCPAddr{Port: 9031}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	clientConnection, userID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	assert.Equal(t, ClientConnected, receiveEvent(t, events).Type)
+
+	// Answering pings keeps the client connected past the timeout.
+	for i := 0; i < 4; i++ {
+		ping, err := protocol.ReadFrame(clientConnection)
+		require.NoError(t, err)
+		require.Equal(t, protocol.FramePing, ping.Type)
+		require.NoError(t, writeRequest(clientConnection, protocol.FramePong, ping.RequestID, ping.Payload))
+	}
+	assert.Contains(t, srv.ListClientIDs(), userID)
+
+	// A client that stops answering is disconnected.
+	event := receiveEvent(t, events)
+	assert.Equal(t, ClientDisconnected, event.Type)
+	assert.Equal(t, userID, event.UserID)
+	assert.ErrorIs(t, event.Err, ErrHeartbeatTimeout)
+}
+
+func TestHeartbeatTimeoutDefaultsToInterval(t *testing.T) {
+	srv := New()
+	srv.SetHeartbeat(time.Second, 0)
+	assert.Equal(t, time.Second, srv.heartbeatTimeout)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := New()
+	srv.SetIdleTimeout(100 * time.Millisecond)
+	events := make(chan LifecycleEvent, 10)
+	srv.OnLifecycleEvent(func(event LifecycleEvent) { events <- event })
+	serverAddr := net.TCPAddr{Port: 9032}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	silentConnection, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer silentConnection.Close()
+
+	clientConnection, userID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	assert.Equal(t, ClientConnected, receiveEvent(t, events).Type)
+
+	// Requests keep the client connected.
+	for i := uint32(1); i <= 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, writeRequest(clientConnection, protocol.FrameWhoAmI, i, nil))
+		response, err := protocol.ReadFrame(clientConnection)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.FrameWhoAmIResponse, response.Type)
+	}
+	assert.Contains(t, srv.ListClientIDs(), userID)
+
+	// Pings are answered with pongs, but do not keep the client connected.
+	started := time.Now()
+	for i := uint32(4); ; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if writeRequest(clientConnection, protocol.FramePing, i, []byte("beat")) != nil {
+			break
+		}
+		pong, err := protocol.ReadFrame(clientConnection)
+		if err != nil {
+			break
+		}
+		assert.Equal(t, protocol.Frame{Version: protocol.Version, Type: protocol.FramePong, RequestID: i, Payload: []byte("beat")}, pong)
+		require.Less(t, time.Since(started), time.Second, "a client sending only pings should be idle")
+	}
+
+	event := receiveEvent(t, events)
+	assert.Equal(t, ClientDisconnected, event.Type)
+	assert.ErrorIs(t, event.Err, ErrIdleTimeout)
+
+	// The connection that never sent a `hello` was closed as well.
+	require.NoError(t, silentConnection.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = silentConnection.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	srv := New(WithHandshakeTimeout(100 * time.Millisecond))
+	serverAddr := net.TCPAddr{Port: 9039}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	silentConnection, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer silentConnection.Close()
+
+	// Without idle timeouts or heartbeats, a connection that sends no hello
+	// is closed all the same.
+	require.NoError(t, silentConnection.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = silentConnection.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// The handshake deadline does not apply once connected.
+	clientConnection, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameWhoAmI, 1, nil))
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameWhoAmIResponse, response.Type)
+}
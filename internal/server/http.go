@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/hashicorp/go-multierror"
+	"net"
+	"net/http"
+)
+
+// serveHTTP serves the handler on laddr until the server stops, over TLS when
+// tlsConfig is set.
+func (server *Server) serveHTTP(laddr *net.TCPAddr, handler http.Handler, tlsConfig *tls.Config) error {
+	listener, err := server.listen(laddr, tlsConfig)
+	if err != nil {
+		server.logger.Error("Listening for HTTP requests failed", "address", laddr.String(), "error", err)
+		return err
+	}
+
+	// Requests, and the WebSocket upgrade among them, get the time of a
+	// handshake to arrive, so connections that send nothing do not stay open.
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: server.handshakeDeadline(), IdleTimeout: server.handshakeDeadline()}
+	server.httpServersMutex.Lock()
+	server.httpServers = append(server.httpServers, httpServer)
+	server.httpServersMutex.Unlock()
+
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			server.logger.Error("Serving HTTP failed", "address", laddr.String(), "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (server *Server) closeHTTPServers(allErrors **multierror.Error) {
+	server.httpServersMutex.Lock()
+	defer server.httpServersMutex.Unlock()
+
+	// Upgraded WebSocket connections are no longer the HTTP server's; they
+	// are closed with the other connections.
+	for _, httpServer := range server.httpServers {
+		err := httpServer.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			server.logger.Error("Closing HTTP server failed", "error", err)
+			*allErrors = multierror.Append(*allErrors, err)
+		}
+	}
+}
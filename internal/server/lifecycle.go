@@ -0,0 +1,75 @@
+package server
+
+import (
+	"time"
+)
+
+type LifecycleEventType int
+
+const (
+	// ClientConnected is emitted when a client completed the handshake.
+	ClientConnected LifecycleEventType = iota + 1
+	// ClientDisconnected is emitted once a client's connection was closed and
+	// it is no longer listed. It is not emitted when another connection takes
+	// over the session, nor when the server stops.
+	ClientDisconnected
+)
+
+func (eventType LifecycleEventType) String() string {
+	switch eventType {
+	case ClientConnected:
+		return "connected"
+	case ClientDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+type LifecycleEvent struct {
+	Type   LifecycleEventType
+	UserID uint64
+	Time   time.Time
+	// Err is why a client was disconnected, io.EOF when it closed the connection.
+	Err error
+}
+
+// OnLifecycleEvent registers a handler called for every lifecycle event.
+// Handlers are called synchronously from the connection's goroutine and must
+// not block.
+func (server *Server) OnLifecycleEvent(handler func(event LifecycleEvent)) {
+	server.lifecycleMutex.Lock()
+	defer server.lifecycleMutex.Unlock()
+
+	server.lifecycleHandlers = append(server.lifecycleHandlers, handler)
+}
+
+func (server *Server) emit(eventType LifecycleEventType, userID uint64, err error) {
+	server.lifecycleMutex.RLock()
+	handlers := server.lifecycleHandlers
+	server.lifecycleMutex.RUnlock()
+
+	event := LifecycleEvent{Type: eventType, UserID: userID, Time: time.Now(), Err: err}
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// deregister removes the client from the connected users and closes its
+// connection. It reports false if the client was already deregistered or
+// replaced by a newer connection of the same user.
+func (server *Server) deregister(client *connection, reason error) bool {
+	client.Close()
+	if !server.connections.CompareAndDelete(client.userID, client) {
+		return false
+	}
+
+	// The session's grace period starts when the user leaves, and so does
+	// the time messages are stored for the user.
+	server.sessions.touch(client.userID)
+	server.forgetSlowConsumer(client)
+	if server.store != nil {
+		server.issued.touch(client.userID)
+	}
+	server.emit(ClientDisconnected, client.userID, reason)
+	return true
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func receiveEvent(t *testing.T, events chan LifecycleEvent) LifecycleEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		require.FailNow(t, "no lifecycle event")
+		return LifecycleEvent{}
+	}
+}
+
+func TestDisconnectedClientIsDeregistered(t *testing.T) {
+	srv := New()
+	events := make(chan LifecycleEvent, 10)
+	srv.OnLifecycleEvent(func(event LifecycleEvent) { events <- event })
+	serverAddr := net.TCPAddr{Port: 9016}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	stayingConnection, stayingID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer stayingConnection.Close()
+	leavingConnection, leavingID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+
+	for _, userID := range []uint64{stayingID, leavingID} {
+		event := receiveEvent(t, events)
+		assert.Equal(t, ClientConnected, event.Type)
+		assert.Equal(t, userID, event.UserID)
+	}
+
+	require.NoError(t, leavingConnection.Close())
+	event := receiveEvent(t, events)
+	assert.Equal(t, ClientDisconnected, event.Type)
+	assert.Equal(t, leavingID, event.UserID)
+	assert.Equal(t, io.EOF, event.Err)
+	assert.Equal(t, []uint64{stayingID}, srv.ListClientIDs())
+
+	require.NoError(t, writeRequest(stayingConnection, protocol.FrameWhoIsHere, 1, nil))
+	response, err := protocol.ReadFrame(stayingConnection)
+	require.NoError(t, err)
+	userIDs, err := protocol.DecodeUserIDs(protocol.LittleEndian, response.Payload)
+	require.NoError(t, err)
+	assert.Empty(t, userIDs, "the disconnected user should not be listed")
+}
+
+func TestTakeoverEmitsNoEvents(t *testing.T) {
+	srv := New()
+	events := make(chan LifecycleEvent, 10)
+	srv.OnLifecycleEvent(func(event LifecycleEvent) { events <- event })
+	serverAddr := net.TCPAddr{Port: 9017}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	first, welcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, ClientConnected, receiveEvent(t, events).Type)
+
+	hello.SessionToken = welcome.SessionToken
+	second, resumed, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, welcome.UserID, resumed.UserID)
+
+	_, err = protocol.ReadFrame(first)
+	assert.Error(t, err, "the stale connection should be closed")
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected lifecycle event", "%s for user_id %d", event.Type, event.UserID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, writeRequest(second, protocol.FrameWhoAmI, 1, nil))
+	response, err := protocol.ReadFrame(second)
+	require.NoError(t, err)
+	assert.Equal(t, welcome.UserID, binary.LittleEndian.Uint64(response.Payload))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/tls"
+	"message-delivery-system/internal/metrics"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"net/http"
+)
+
+// serverMetrics are the metrics the hub keeps about itself.
+type serverMetrics struct {
+	connectionsAccepted *metrics.Counter
+	handshakeFailures   *metrics.Counter
+	connectionsRejected *metrics.Counter
+	framesReceived      *metrics.CounterVec
+	receivedBytes       *metrics.Counter
+	sentBytes           *metrics.Counter
+	writeErrors         *metrics.Counter
+	requestDuration     *metrics.Histogram
+	fanOut              *metrics.Histogram
+	messagesDelivered   *metrics.Counter
+	// messagesDropped counts undelivered messages by reason: "offline" for
+	// receivers that are not connected, when the message is not stored,
+	// "store_full", "slow_consumer" and "failed".
+	messagesDropped *metrics.CounterVec
+	// timeouts counts clients disconnected by reason: "heartbeat" or "idle".
+	timeouts *metrics.CounterVec
+}
+
+var fanOutBuckets = []float64{1, 2, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		connectionsAccepted: registry.NewCounter("mds_connections_accepted_total", "Connections accepted over TCP and WebSocket."),
+		handshakeFailures:   registry.NewCounter("mds_handshake_failures_total", "Connections closed before the client got a user ID."),
+		connectionsRejected: registry.NewCounter("mds_connections_rejected_total", "Connections closed because the hub had as many as it accepts."),
+		framesReceived:      registry.NewCounterVec("mds_frames_received_total", "Frames received from clients by frame type.", "type"),
+		receivedBytes:       registry.NewCounter("mds_received_bytes_total", "Bytes of the frames received from clients."),
+		sentBytes:           registry.NewCounter("mds_sent_bytes_total", "Bytes of the frames written to clients."),
+		writeErrors:         registry.NewCounter("mds_write_errors_total", "Errors writing frames to clients."),
+		requestDuration:     registry.NewHistogram("mds_request_duration_seconds", "Time taken to handle a request.", metrics.DefaultBuckets),
+		fanOut:              registry.NewHistogram("mds_relay_fan_out", "Recipients of relay, broadcast and publish requests.", fanOutBuckets),
+		messagesDelivered:   registry.NewCounter("mds_messages_delivered_total", "Messages queued for connected recipients."),
+		messagesDropped:     registry.NewCounterVec("mds_messages_dropped_total", "Messages not delivered by reason.", "reason"),
+		timeouts:            registry.NewCounterVec("mds_connections_timed_out_total", "Clients disconnected for sending nothing in time by reason.", "reason"),
+	}
+}
+
+// observeFanOut records the number of recipients of a relay, broadcast or
+// publish request.
+func (serverMetrics *serverMetrics) observeFanOut(status protocol.RelayStatus) {
+	serverMetrics.fanOut.Observe(float64(len(status.Delivered) + len(status.Offline) + len(status.Failed)))
+}
+
+// Metrics returns the registry of the hub's metrics, for registering more
+// metrics served along with them.
+func (server *Server) Metrics() *metrics.Registry {
+	return server.metricsRegistry
+}
+
+// MetricsHandler serves the hub's metrics in the Prometheus text format.
+func (server *Server) MetricsHandler() http.Handler {
+	return server.metricsRegistry.Handler()
+}
+
+// StartMetrics serves the hub's metrics on laddr, at any path, over TLS when
+// a TLS config is set.
+func (server *Server) StartMetrics(laddr *net.TCPAddr) error {
+	return server.serveHTTP(laddr, server.MetricsHandler(), server.operatorTLSConfig(server.metricsTLSConfig))
+}
+
+// SetMetricsTLSConfig sets the TLS config of StartMetrics, in place of the one
+// of SetTLSConfig. It must be called before StartMetrics.
+func (server *Server) SetMetricsTLSConfig(config *tls.Config) {
+	server.metricsTLSConfig = config
+}
+
+func (server *Server) connectedCount() float64 {
+	var count int
+	server.connections.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return float64(count)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9026}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	sender, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, receiverID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{receiverID, 12345}, []byte("counted"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(sender, protocol.FrameRelay, 1, payload))
+	response, err := protocol.ReadFrame(sender)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameRelayStatus, response.Type)
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	scrape := recorder.Body.String()
+	assert.Contains(t, scrape, "mds_connections_accepted_total 2\n")
+	assert.Contains(t, scrape, "mds_connections_active 2\n")
+	assert.Contains(t, scrape, "mds_frames_received_total{type=\"relay\"} 1\n")
+	assert.Contains(t, scrape, "mds_messages_delivered_total 1\n")
+	assert.Contains(t, scrape, "mds_messages_dropped_total{reason=\"offline\"} 1\n")
+	assert.Contains(t, scrape, "mds_relay_fan_out_bucket{le=\"2\"} 1\n")
+	// The duration is observed after the answer is queued, so it may not be in yet.
+	assert.Contains(t, scrape, "# TYPE mds_request_duration_seconds histogram\n")
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"message-delivery-system/internal/auth"
+	"time"
+)
+
+// Option configures a Server created by New. Each option does what the
+// setter of the same name does.
+type Option func(server *Server)
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(server *Server) { server.SetLogger(logger) }
+}
+
+func WithAuthenticator(authenticator auth.Authenticator) Option {
+	return func(server *Server) { server.SetAuthenticator(authenticator) }
+}
+
+func WithTLSConfig(config *tls.Config) Option {
+	return func(server *Server) { server.SetTLSConfig(config) }
+}
+
+func WithSessionGracePeriod(gracePeriod time.Duration) Option {
+	return func(server *Server) { server.SetSessionGracePeriod(gracePeriod) }
+}
+
+func WithOutboundQueueSize(size int) Option {
+	return func(server *Server) { server.SetOutboundQueueSize(size) }
+}
+
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(server *Server) { server.SetSlowConsumerPolicy(policy) }
+}
+
+func WithMessageStore(store MessageStore) Option {
+	return func(server *Server) { server.SetMessageStore(store) }
+}
+
+func WithAdminTLSConfig(config *tls.Config) Option {
+	return func(server *Server) { server.SetAdminTLSConfig(config) }
+}
+
+func WithMetricsTLSConfig(config *tls.Config) Option {
+	return func(server *Server) { server.SetMetricsTLSConfig(config) }
+}
+
+func WithAdminToken(token string) Option {
+	return func(server *Server) { server.SetAdminToken(token) }
+}
+
+func WithHeartbeat(interval time.Duration, timeout time.Duration) Option {
+	return func(server *Server) { server.SetHeartbeat(interval, timeout) }
+}
+
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(server *Server) { server.SetIdleTimeout(timeout) }
+}
+
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(server *Server) { server.SetHandshakeTimeout(timeout) }
+}
+
+func WithMaxConnections(max int) Option {
+	return func(server *Server) { server.SetMaxConnections(max) }
+}
+
+func WithMaxMessageSize(size int) Option {
+	return func(server *Server) { server.SetMaxMessageSize(size) }
+}
+
+func WithIDGenerator(generateID func() uint64) Option {
+	return func(server *Server) { server.SetIDGenerator(generateID) }
+}
+
+// WithLifecycleHandler registers a handler of lifecycle events, as
+// OnLifecycleEvent does.
+func WithLifecycleHandler(handler func(event LifecycleEvent)) Option {
+	return func(server *Server) { server.OnLifecycleEvent(handler) }
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"message-delivery-system/internal/protocol"
+	"sync/atomic"
+)
+
+// notifyPresence pushes `user_joined` and `user_left` frames to the clients
+// that subscribed to presence, except to the user the event is about. It runs
+// on the goroutine of the client the event is about, so it never waits for a
+// slow subscriber.
+func (server *Server) notifyPresence(event LifecycleEvent) {
+	frameType := protocol.FrameUserJoined
+	if event.Type == ClientDisconnected {
+		frameType = protocol.FrameUserLeft
+	}
+	payload := protocol.EncodeUserID(event.UserID)
+
+	server.connections.Range(func(userID, value interface{}) bool {
+		subscriber := value.(*connection)
+		if userID.(uint64) == event.UserID || atomic.LoadInt32(&subscriber.presence) == 0 {
+			return true
+		}
+
+		err := subscriber.notify(protocol.Frame{Version: subscriber.version, Type: frameType, Payload: payload})
+		if err == errSlowConsumer {
+			server.deregister(subscriber, err)
+		}
+		if err != nil {
+			subscriber.logger.Warn("Sending presence event failed", "message_type", frameType.String(), "error", err)
+		}
+		return true
+	})
+}
+
+// handleSubscribePresenceRequest answers with the users connected at the time
+// of the subscription; changes after it are pushed.
+var handleSubscribePresenceRequest = func(server *Server, client *connection, request protocol.Frame) {
+	atomic.StoreInt32(&client.presence, 1)
+	handleWhoIsHereRequest(server, client, request)
+}
+
+var handleUnsubscribePresenceRequest = func(server *Server, client *connection, request protocol.Frame) {
+	atomic.StoreInt32(&client.presence, 0)
+	err := client.respond(request, protocol.FrameAck, nil)
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"testing"
+)
+
+func TestPresenceNotifications(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9018}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	subscriber, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer subscriber.Close()
+	present, presentID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer present.Close()
+
+	require.NoError(t, writeRequest(subscriber, protocol.FrameSubscribePresence, 1, nil))
+	response, err := protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameWhoIsHereResponse, response.Type)
+	userIDs, err := protocol.DecodeUserIDs(protocol.LittleEndian, response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{presentID}, userIDs, "the subscription should return the connected users")
+
+	joining, joiningID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	frame, err := protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameUserJoined, frame.Type)
+	userID, err := protocol.DecodeUserID(frame.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, joiningID, userID)
+
+	require.NoError(t, joining.Close())
+	frame, err = protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameUserLeft, frame.Type)
+	userID, err = protocol.DecodeUserID(frame.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, joiningID, userID)
+
+	require.NoError(t, writeRequest(subscriber, protocol.FrameUnsubscribePresence, 2, nil))
+	response, err = protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameAck, response.Type)
+
+	late, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer late.Close()
+	require.NoError(t, writeRequest(subscriber, protocol.FrameWhoAmI, 3, nil))
+	response, err = protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameWhoAmIResponse, response.Type, "unsubscribed clients should not get presence frames")
+}
@@ -1,52 +1,234 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/go-multierror"
+	"log/slog"
+	"message-delivery-system/internal/auth"
+	"message-delivery-system/internal/metrics"
+	"message-delivery-system/internal/protocol"
+	"message-delivery-system/internal/utility"
 	"net"
+	"net/http"
 	"sync"
-	"message-delivery-system/internal/utility"
+	"sync/atomic"
+	"time"
 )
 
-var MESSAGE_TYPES = map[string]func(server *Server, c net.Conn){
-	"who_am_i":    handleWhoAmIRequest,
-	"who_is_here": handleWhoIsHereRequest,
-	"relay":       handleRelayRequest,
+var MESSAGE_TYPES = map[protocol.FrameType]func(server *Server, c *connection, request protocol.Frame){
+	protocol.FrameWhoAmI:              handleWhoAmIRequest,
+	protocol.FrameWhoIsHere:           handleWhoIsHereRequest,
+	protocol.FrameRelay:               handleRelayRequest,
+	protocol.FrameSubscribePresence:   handleSubscribePresenceRequest,
+	protocol.FrameUnsubscribePresence: handleUnsubscribePresenceRequest,
+	protocol.FrameSubscribe:           handleSubscribeRequest,
+	protocol.FrameUnsubscribe:         handleUnsubscribeRequest,
+	protocol.FramePublish:             handlePublishRequest,
+	protocol.FrameTopicMembers:        handleTopicMembersRequest,
+	protocol.FrameBroadcast:           handleBroadcastRequest,
+	protocol.FramePing:                handlePingRequest,
+	protocol.FramePong:                handlePongRequest,
 }
 
 type Server struct {
-	listener    net.Listener
-	connections sync.Map
+	listener      net.Listener
+	connections   sync.Map
+	store         MessageStore
+	issued        *issuedUsers
+	storeLocks    [storeLockStripes]sync.Mutex
+	sessions      *sessionRegistry
+	topics        *topicRegistry
+	authenticator auth.Authenticator
+	tlsConfig     *tls.Config
+	adminToken    string
+	generateID    func() uint64
+	queueSize     int
+	// maxConnections is off when 0.
+	maxConnections   int
+	maxMessageSize   int
+	connectionsCount int64
+	// heartbeatInterval, heartbeatTimeout and idleTimeout are off when 0.
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	idleTimeout       time.Duration
+	handshakeTimeout  time.Duration
+	// slowConsumerPolicy picks the policy for a newly registered user.
+	slowConsumerPolicy func(userID uint64) SlowConsumerPolicy
+	slowConsumers      sync.Map
+
+	// httpServers serve the WebSocket listener and the admin API.
+	httpServers      []*http.Server
+	httpServersMutex sync.Mutex
+	// adminTLSConfig and metricsTLSConfig replace tlsConfig for the admin
+	// API and the metrics.
+	adminTLSConfig   *tls.Config
+	metricsTLSConfig *tls.Config
+
+	metricsRegistry *metrics.Registry
+	metrics         *serverMetrics
+	logger          *slog.Logger
+	// nextConnectionID numbers the accepted connections for the logs.
+	nextConnectionID uint64
+
+	lifecycleHandlers []func(event LifecycleEvent)
+	lifecycleMutex    sync.RWMutex
+
+	// handshaking holds the accepted connections that have no user ID yet.
+	handshaking sync.Map
+	handlers    sync.WaitGroup
+	quit        chan struct{}
+	quitOnce    sync.Once
+	// sweepInterval is how often expired state is dropped.
+	sweepInterval time.Duration
+	sweepOnce     sync.Once
+}
+
+// New creates a server configured by the options. Options and setters can be
+// mixed; either must be applied before Start.
+func New(options ...Option) *Server {
+	server := &Server{
+		listener:       nil,
+		connections:    sync.Map{},
+		sessions:       newSessionRegistry(defaultSessionGracePeriod),
+		topics:         newTopicRegistry(),
+		issued:         newIssuedUsers(),
+		generateID:     utility.GenerateID,
+		queueSize:      defaultOutboundQueueSize,
+		maxMessageSize: protocol.MaxPayloadLength,
+		slowConsumerPolicy: func(uint64) SlowConsumerPolicy {
+			return SlowConsumerPolicy{Action: DropNewest}
+		},
+		metricsRegistry:  metrics.NewRegistry(),
+		logger:           slog.Default(),
+		quit:             make(chan struct{}),
+		sweepInterval:    defaultSweepInterval,
+		handshakeTimeout: defaultHandshakeTimeout,
+	}
+	server.metrics = newServerMetrics(server.metricsRegistry)
+	server.metricsRegistry.NewGaugeFunc("mds_connections_active", "Clients with a user ID.", server.connectedCount)
+	server.OnLifecycleEvent(server.notifyPresence)
+	server.OnLifecycleEvent(server.dropSubscriptions)
+	for _, option := range options {
+		option(server)
+	}
+	return server
+}
+
+// SetLogger sets the logger for the server's events. Events about a client
+// carry its connection_id and, once it has one, its user_id. Use the level of
+// the logger's handler to choose how much is logged: client errors are logged
+// at Warn, failures of the hub at Error and every request at Debug. It must be
+// called before Start.
+func (server *Server) SetLogger(logger *slog.Logger) {
+	server.logger = logger
+}
+
+// Logger returns the logger the server logs to.
+func (server *Server) Logger() *slog.Logger {
+	return server.logger
+}
+
+// SetAuthenticator makes the server check the credentials of every new
+// connection before it gets a user ID. Authenticated subjects always get the
+// same user ID. It must be called before Start.
+func (server *Server) SetAuthenticator(authenticator auth.Authenticator) {
+	server.authenticator = authenticator
+}
+
+// SetTLSConfig makes the server accept TLS connections only. When the config
+// verifies client certificates, the common name of the certificate becomes the
+// client's identity, as with an authenticator. The admin API and the metrics
+// use the config too, without asking for client certificates, unless they
+// have their own. It must be called before Start.
+func (server *Server) SetTLSConfig(config *tls.Config) {
+	server.tlsConfig = config
+}
+
+// SetSessionGracePeriod sets how long a session token stays resumable after
+// its user was last seen.
+func (server *Server) SetSessionGracePeriod(gracePeriod time.Duration) {
+	server.sessions.setGracePeriod(gracePeriod)
+}
+
+// SetOutboundQueueSize sets how many frames may be queued for a client that
+// has not read them yet. It must be called before Start.
+func (server *Server) SetOutboundQueueSize(size int) {
+	server.queueSize = size
+}
+
+// SetSlowConsumerPolicy sets what happens to messages relayed to clients
+// whose outbound queue is full. The default is DropNewest. It must be called
+// before Start.
+func (server *Server) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	server.slowConsumerPolicy = func(uint64) SlowConsumerPolicy { return policy }
+}
+
+// SetSlowConsumerPolicyFunc picks the slow consumer policy for each user when
+// it connects. It must be called before Start.
+func (server *Server) SetSlowConsumerPolicyFunc(policy func(userID uint64) SlowConsumerPolicy) {
+	server.slowConsumerPolicy = policy
+}
+
+// SetMessageStore makes the server queue messages for recipients that are not
+// connected and deliver them when the recipient connects. Messages are only
+// stored for user IDs the hub handed out, until the user has been gone for
+// the store's TTL, or a day for stores that are not an ExpiringStore. It must
+// be called before Start.
+func (server *Server) SetMessageStore(store MessageStore) {
+	server.store = store
+}
+
+// SetMaxConnections limits the connections the hub holds at once, over TCP
+// and WebSocket together; 0 means no limit. Only connections that sent a valid
+// `hello` count, and the ones beyond the limit get an error frame and are
+// closed. It must be called before Start.
+func (server *Server) SetMaxConnections(max int) {
+	server.maxConnections = max
+}
+
+// SetMaxMessageSize limits the payload of the frames clients send. Larger
+// frames are answered with an error. Sizes out of range restore
+// protocol.MaxPayloadLength. It must be called before Start.
+func (server *Server) SetMaxMessageSize(size int) {
+	if size <= 0 || size > protocol.MaxPayloadLength {
+		size = protocol.MaxPayloadLength
+	}
+	server.maxMessageSize = size
 }
 
-func New() *Server {
-	return &Server{listener: nil, connections: sync.Map{}}
+// SetIDGenerator sets how anonymous clients get their user ID, random by
+// default. See utility.NewSequentialIDGenerator. It must be called before
+// Start.
+func (server *Server) SetIDGenerator(generateID func() uint64) {
+	server.generateID = generateID
 }
 
 func (server *Server) Start(laddr *net.TCPAddr) error {
-	listener, err := net.Listen("tcp", laddr.String())
+	listener, err := server.listen(laddr, server.tlsConfig)
 	if err != nil {
-		fmt.Errorf(err.Error())
+		server.logger.Error("Listening for clients failed", "address", laddr.String(), "error", err)
 		return err
 	}
 
 	server.listener = listener
+	server.startSweeping()
 
 	go func() {
 		for {
 			connection, err := server.listener.Accept()
 			if err != nil {
-				fmt.Errorf("Error accepting a client connection: %s", err.Error())
+				if server.stopping() {
+					return
+				}
+				server.logger.Error("Accepting a client connection failed", "error", err)
 				continue
 			}
 
-			userID := utility.GenerateID()
-			server.connections.Store(userID, connection)
-
-			fmt.Printf("Start handling client connection with userID: %d\n", userID)
+			server.track(connection)
 			go server.handleConnection(connection)
 		}
 	}()
@@ -54,28 +236,137 @@ func (server *Server) Start(laddr *net.TCPAddr) error {
 	return nil
 }
 
+// listen listens on laddr for TLS connections when tlsConfig is set.
+func (server *Server) listen(laddr *net.TCPAddr, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig != nil {
+		return tls.Listen("tcp", laddr.String(), tlsConfig)
+	}
+	return net.Listen("tcp", laddr.String())
+}
+
+// operatorTLSConfig returns the TLS config of a listener for operators: its
+// own config when set, or the one of the hub without client certificates,
+// which are for the hub's clients.
+func (server *Server) operatorTLSConfig(config *tls.Config) *tls.Config {
+	if config != nil || server.tlsConfig == nil {
+		return config
+	}
+	config = server.tlsConfig.Clone()
+	config.ClientAuth = tls.NoClientCert
+	config.ClientCAs = nil
+	return config
+}
+
+// Stop closes the listener and every connection immediately. Use Shutdown to
+// let the requests being handled finish first.
 func (server *Server) Stop() error {
 	var allErrors *multierror.Error
 
-	server.connections.Range(func(userID, connection interface{}) bool {
-		conn := connection.(net.Conn)
-		err := conn.Close()
+	server.quitOnce.Do(func() { close(server.quit) })
+	server.closeHTTPServers(&allErrors)
+	server.closeConnections(&allErrors)
+
+	err := server.listener.Close()
+	if err != nil {
+		server.logger.Error("Closing the listener failed", "error", err)
+		allErrors = multierror.Append(allErrors, err)
+	}
+
+	return allErrors.ErrorOrNil()
+}
+
+// Shutdown stops accepting connections, sends a `going_away` frame to every
+// client and waits until the requests being handled are answered and all
+// connection handlers have returned. The connections are then closed. If ctx
+// expires first, the connections are closed right away and ctx's error is
+// returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	var allErrors *multierror.Error
+
+	server.quitOnce.Do(func() { close(server.quit) })
+	err := server.listener.Close()
+	if err != nil {
+		server.logger.Error("Closing the listener failed", "error", err)
+		allErrors = multierror.Append(allErrors, err)
+	}
+	server.closeHTTPServers(&allErrors)
+
+	goingAway := protocol.Frame{Version: protocol.Version, Type: protocol.FrameGoingAway, Payload: protocol.EncodeGoingAway("hub is shutting down")}
+	server.connections.Range(func(_, value interface{}) bool {
+		client := value.(*connection)
+		err := client.offer(goingAway)
 		if err != nil {
-			fmt.Errorf("Error closing connection for client with user_id %d: %s", userID, err.Error())
-			allErrors = multierror.Append(allErrors, err)
+			client.logger.Warn("Sending going_away failed", "message_type", goingAway.Type.String(), "error", err)
 		}
+		// Wake up the handler blocked on reading the next request.
+		client.SetReadDeadline(time.Now())
+		return true
+	})
+	server.handshaking.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).SetReadDeadline(time.Now())
 		return true
 	})
 
-	err := server.listener.Close()
-	if err != nil {
-		fmt.Errorf("Error closing server: %s", err.Error())
-		allErrors = multierror.Append(allErrors, err)
+	drained := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		// Let the writers flush the answers to the requests handled last.
+		server.connections.Range(func(_, value interface{}) bool {
+			client := value.(*connection)
+			client.closeWhenDrained()
+			<-client.writerDone
+			return true
+		})
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		allErrors = multierror.Append(allErrors, ctx.Err())
 	}
 
+	server.closeConnections(&allErrors)
 	return allErrors.ErrorOrNil()
 }
 
+func (server *Server) closeConnections(allErrors **multierror.Error) {
+	server.connections.Range(func(_, value interface{}) bool {
+		client := value.(*connection)
+		err := client.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			client.logger.Warn("Closing the connection failed", "error", err)
+			*allErrors = multierror.Append(*allErrors, err)
+		}
+		return true
+	})
+	server.handshaking.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+}
+
+// track counts a new connection among the handlers Shutdown waits for and
+// lists it as handshaking until it gets a user ID.
+func (server *Server) track(conn net.Conn) {
+	server.metrics.connectionsAccepted.Inc()
+	server.handlers.Add(1)
+	server.handshaking.Store(conn, struct{}{})
+	conn.SetDeadline(time.Now().Add(server.handshakeDeadline()))
+	if server.stopping() {
+		// Shutdown may have looked at the handshaking connections already.
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (server *Server) stopping() bool {
+	select {
+	case <-server.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (server *Server) ListClientIDs() []uint64 {
 	var userIDs []uint64
 
@@ -87,158 +378,504 @@ func (server *Server) ListClientIDs() []uint64 {
 	return userIDs
 }
 
-func (server *Server) handleConnection(connection net.Conn) {
+func (server *Server) handleConnection(conn net.Conn) {
+	defer server.handlers.Done()
+
+	logger := server.logger.With("connection_id", atomic.AddUint64(&server.nextConnectionID, 1))
+	logger.Debug("Accepted connection", "remote_addr", conn.RemoteAddr().String())
+
+	reader := protocol.NewReader(conn)
+	version, codec, hello, err := server.handshake(conn, reader, logger)
+	if err != nil {
+		logger.Warn("Handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		server.metrics.handshakeFailures.Inc()
+		server.handshaking.Delete(conn)
+		conn.Close()
+		return
+	}
+	reader.SetMaxPayloadLength(server.maxMessageSize)
+
+	// Connections count once their hello is read, so neither idle nor
+	// malformed connections take the places of clients, and a client over the
+	// limit gets the error rather than a reset connection.
+	count := atomic.AddInt64(&server.connectionsCount, 1)
+	defer atomic.AddInt64(&server.connectionsCount, -1)
+	if server.maxConnections > 0 && count > int64(server.maxConnections) {
+		logger.Warn("Rejected connection", "remote_addr", conn.RemoteAddr().String(), "max_connections", server.maxConnections)
+		sendError(logger, conn, protocol.Frame{Version: version}, protocol.ErrorLimitExceeded, "hub has too many connections")
+		server.metrics.connectionsRejected.Inc()
+		server.handshaking.Delete(conn)
+		conn.Close()
+		return
+	}
+
+	identity, err := server.authenticate(conn, hello)
+	if err != nil {
+		logger.Warn("Authentication failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		sendError(logger, conn, protocol.Frame{Version: version}, protocol.ErrorUnauthorized, err.Error())
+		server.metrics.handshakeFailures.Inc()
+		server.handshaking.Delete(conn)
+		conn.Close()
+		return
+	}
+
+	userID, sessionToken, resumed, err := server.identify(hello, identity)
+	if err != nil {
+		logger.Error("Assigning a user ID failed", "error", err)
+		server.metrics.handshakeFailures.Inc()
+		server.handshaking.Delete(conn)
+		conn.Close()
+		return
+	}
+	logger = logger.With("user_id", userID)
+	client := newConnection(conn, userID, version, codec, server.queueSize, server.slowConsumerPolicy(userID), server.slowConsumerCounters(userID), server.metrics, logger)
+
+	welcome := protocol.Welcome{Version: version, UserID: userID, Resumed: resumed, SessionToken: sessionToken, Codec: codec.Name()}
+	err = client.send(protocol.Frame{Version: version, Type: protocol.FrameWelcome, Payload: welcome.Encode()})
+	if err != nil {
+		logger.Warn("Sending welcome failed", "message_type", protocol.FrameWelcome.String(), "error", err)
+	}
+	if previous, ok := server.publish(client); ok {
+		// A resumed session or an authenticated subject is still attached to a
+		// stale connection. The user stays connected, so no events are emitted.
+		previous.(*connection).Close()
+	} else {
+		server.emit(ClientConnected, userID, nil)
+	}
+	server.handshaking.Delete(conn)
+	if server.heartbeatInterval > 0 {
+		go client.heartbeat(server.heartbeatInterval)
+	}
+
+	logger.Info("Client connected", "remote_addr", conn.RemoteAddr().String(), "resumed", resumed, "version", version, "codec", codec.Name())
+	conn.SetWriteDeadline(time.Time{})
+	lastActivity := time.Now()
 	for {
-		messageTypeLengthBuffer := make([]byte, 1)
-		_, err := connection.Read(messageTypeLengthBuffer)
-		if err != nil {
-			fmt.Errorf("Error reading message type length: %s", err.Error())
-			continue
+		// Shutdown wakes the handler with a deadline set after it started
+		// stopping, so extend the deadline before checking.
+		server.extendReadDeadline(conn, lastActivity)
+		if server.stopping() {
+			// Shutdown closes the connection once every handler has returned.
+			return
+		}
+
+		request, err := reader.ReadFrame()
+		if err == protocol.ErrFrameTooLarge {
+			// The payload is left unread, so the connection cannot be read
+			// any further.
+			logger.Warn("Closing connection after oversized frame", "message_type", request.Type.String())
+			client.sendError(request, protocol.ErrorLimitExceeded,
+				fmt.Sprintf("frame payload exceeds %d bytes", server.maxMessageSize))
+			client.closeWhenDrained()
+			select {
+			case <-client.writerDone:
+			case <-time.After(drainTimeout):
+			}
+			server.deregister(client, err)
+			return
 		}
-		messageLength, err := binary.ReadUvarint(bytes.NewBuffer(messageTypeLengthBuffer))
 		if err != nil {
-			fmt.Errorf("Incorrect message type length: %s", err.Error())
-			continue
+			if server.stopping() {
+				return
+			}
+			err = server.timedOut(err, lastActivity)
+			logger.Info("Client disconnected", "error", err)
+			server.deregister(client, err)
+			return
+		}
+		if isActivity(request.Type) {
+			lastActivity = time.Now()
 		}
+		atomic.AddUint64(&client.framesReceived, 1)
+		server.metrics.framesReceived.With(request.Type.String()).Inc()
+		server.metrics.receivedBytes.Add(uint64(protocol.HeaderLength + len(request.Payload)))
+		server.sessions.touch(userID)
+
+		logger.Debug("Received request", "message_type", request.Type.String(), "request_id", request.RequestID)
+		if handler, ok := MESSAGE_TYPES[request.Type]; ok {
+			start := time.Now()
+			handler(server, client, request)
+			server.metrics.requestDuration.Observe(time.Since(start).Seconds())
+		} else {
+			logger.Warn("Unknown message type", "message_type", request.Type.String())
+			client.sendError(request, protocol.ErrorUnknownFrameType, fmt.Sprintf("unknown message type %s", request.Type))
+		}
+	}
+}
 
-		messageTypeBuffer := make([]byte, messageLength)
-		_, err = connection.Read(messageTypeBuffer)
+// handshake expects a `hello` frame and negotiates the protocol version and
+// the codec for user ID lists. Legacy clients, which do not send the frame
+// magic, get an error frame back.
+func (server *Server) handshake(connection net.Conn, reader *protocol.Reader, logger *slog.Logger) (byte, protocol.Codec, protocol.Hello, error) {
+	var helloRequest protocol.Hello
+	hello := protocol.Frame{Version: protocol.Version}
+
+	reader.SetMaxPayloadLength(protocol.MaxHelloLength)
+	request, err := reader.ReadFrame()
+	if err == protocol.ErrFrameTooLarge {
+		sendError(logger, connection, request, protocol.ErrorLimitExceeded, fmt.Sprintf("hello frame exceeds %d bytes", protocol.MaxHelloLength))
+		return 0, nil, helloRequest, err
+	}
+	if err == protocol.ErrInvalidMagic {
+		sendError(logger, connection, hello, protocol.ErrorUnsupportedProtocol, "legacy protocol is not supported, upgrade the client")
+		return 0, nil, helloRequest, err
+	}
+	if err != nil {
+		return 0, nil, helloRequest, err
+	}
+
+	if request.Type != protocol.FrameHello {
+		sendError(logger, connection, request, protocol.ErrorHandshakeRequired, "expected hello frame")
+		return 0, nil, helloRequest, fmt.Errorf("expected hello frame, got %s", request.Type)
+	}
+
+	helloRequest, err = protocol.DecodeHello(request.Payload)
+	if err != nil {
+		sendError(logger, connection, request, protocol.ErrorMalformedRequest, "malformed hello frame")
+		return 0, nil, helloRequest, err
+	}
+
+	version, ok := protocol.NegotiateVersion(helloRequest)
+	if !ok {
+		sendError(logger, connection, request, protocol.ErrorUnsupportedVersion,
+			fmt.Sprintf("supported protocol versions are %d-%d", protocol.MinVersion, protocol.Version))
+		return 0, nil, helloRequest, fmt.Errorf("no common protocol version with client range %d-%d", helloRequest.MinVersion, helloRequest.MaxVersion)
+	}
+
+	codec, ok := protocol.NegotiateCodec(version, helloRequest.Codec)
+	if !ok {
+		sendError(logger, connection, request, protocol.ErrorUnsupportedCodec, fmt.Sprintf("unsupported codec %q", helloRequest.Codec))
+		return 0, nil, helloRequest, fmt.Errorf("unsupported codec %q", helloRequest.Codec)
+	}
+
+	return version, codec, helloRequest, nil
+}
+
+// authenticate combines the identity of a verified client certificate with
+// the one the authenticator derives from the credentials in the hello.
+func (server *Server) authenticate(connection net.Conn, hello protocol.Hello) (auth.Identity, error) {
+	var identity auth.Identity
+	// Both *tls.Conn and WebSocket connections over TLS report their state.
+	if tlsConnection, ok := connection.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tlsConnection.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			identity.Subject = state.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+
+	if server.authenticator == nil {
+		return identity, nil
+	}
+
+	credentialsIdentity, err := server.authenticator.Authenticate(hello.Credentials)
+	if err != nil {
+		return identity, err
+	}
+	if identity.Subject == "" {
+		return credentialsIdentity, nil
+	}
+	if credentialsIdentity.Subject != "" && credentialsIdentity.Subject != identity.Subject {
+		return identity, auth.ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// identify resumes the session presented in the hello, or starts a new session
+// when there is none or it has expired. Anonymous clients get a fresh user ID,
+// authenticated ones the ID derived from their subject.
+func (server *Server) identify(hello protocol.Hello, identity auth.Identity) (uint64, string, bool, error) {
+	userID := server.generateID
+	if identity.Subject != "" {
+		userID = func() uint64 { return utility.GenerateIDFromSubject(identity.Subject) }
+	}
+
+	if hello.SessionToken != "" {
+		resumedUserID, ok := server.sessions.resume(hello.SessionToken, server.isConnected)
+		if ok && (identity.Subject == "" || resumedUserID == userID()) {
+			return resumedUserID, hello.SessionToken, true, nil
+		}
+	}
+
+	sessionToken, err := utility.GenerateToken()
+	if err != nil {
+		return 0, "", false, err
+	}
+	newUserID := userID()
+	server.sessions.create(sessionToken, newUserID)
+	if server.store != nil {
+		server.issued.touch(newUserID)
+	}
+	return newUserID, sessionToken, false, nil
+}
+
+func (server *Server) isConnected(userID uint64) bool {
+	_, ok := server.connections.Load(userID)
+	return ok
+}
+
+// publish makes the connection the one the user's messages are delivered to,
+// and returns the connection it replaces. The messages stored while the user
+// was offline are queued first: until the connection is published, relays
+// store their messages behind them.
+func (server *Server) publish(client *connection) (interface{}, bool) {
+	if server.store == nil {
+		return server.connections.Swap(client.userID, client)
+	}
+
+	lock := server.storeLock(client.userID)
+	for {
+		lock.Lock()
+		messages, err := server.store.Flush(client.userID)
 		if err != nil {
-			fmt.Errorf("Error reading message type: %s", err.Error())
-			continue
+			client.logger.Error("Flushing stored messages failed", "error", err)
 		}
-		messageType := string(messageTypeBuffer)
-		if request, ok := MESSAGE_TYPES[messageType]; ok {
-			request(server, connection)
-		} else {
-			fmt.Errorf("Incorrect message type: %s", messageType)
-			continue
+		if len(messages) == 0 {
+			previous, ok := server.connections.Swap(client.userID, client)
+			lock.Unlock()
+			return previous, ok
+		}
+		lock.Unlock()
+
+		if !server.deliverStored(client, messages) {
+			lock.Lock()
+			previous, ok := server.connections.Swap(client.userID, client)
+			lock.Unlock()
+			return previous, ok
 		}
 	}
 }
 
-var handleWhoAmIRequest = func(server *Server, clientConnection net.Conn) {
-	server.connections.Range(func(userID, connection interface{}) bool {
-		conn := connection.(net.Conn)
-		if conn == clientConnection {
-			userIDBytes := make([]byte, 8)
-			binary.LittleEndian.PutUint64(userIDBytes, userID.(uint64))
-			_, err := clientConnection.Write(userIDBytes)
-			if err != nil {
-				fmt.Errorf("Error sending `who_am_i` response to client with user_id %d: %s", userID, err.Error())
+// deliverStored queues the stored messages for the client. When the
+// connection fails, the undelivered messages are stored again for the next
+// one and false is returned.
+func (server *Server) deliverStored(client *connection, messages []StoredMessage) bool {
+	for i, message := range messages {
+		frame := protocol.Frame{Version: client.version, Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(message.SenderID, message.Body)}
+		err := client.send(frame)
+		if err != nil {
+			client.logger.Warn("Delivering stored message failed", "message_type", frame.Type.String(), "error", err)
+			for _, undelivered := range messages[i:] {
+				server.store.Store(client.userID, undelivered)
 			}
 			return false
 		}
-		return true
-	})
+	}
+	return true
+}
+
+// storeLock returns the lock ordering the storing of the user's messages
+// against publishing the user's connection.
+func (server *Server) storeLock(userID uint64) *sync.Mutex {
+	return &server.storeLocks[userID%storeLockStripes]
+}
+
+func sendError(logger *slog.Logger, clientConnection net.Conn, request protocol.Frame, code protocol.ErrorCode, message string) {
+	protocolError := protocol.Error{Code: code, Message: message}
+	response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameError, RequestID: request.RequestID, Payload: protocolError.Encode()}
+	err := protocol.WriteFrame(clientConnection, response)
+	if err != nil {
+		logger.Warn("Sending error frame failed", "message_type", request.Type.String(), "error", err)
+	}
 }
 
-var handleWhoIsHereRequest = func(server *Server, clientConnection net.Conn) {
+func (client *connection) sendError(request protocol.Frame, code protocol.ErrorCode, message string) {
+	protocolError := protocol.Error{Code: code, Message: message}
+	response := protocol.Frame{Version: protocol.Version, Type: protocol.FrameError, RequestID: request.RequestID, Payload: protocolError.Encode()}
+	err := client.send(response)
+	if err != nil {
+		client.logger.Warn("Sending error frame failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+func (client *connection) respond(request protocol.Frame, frameType protocol.FrameType, payload []byte) error {
+	response := protocol.Frame{Version: request.Version, Type: frameType, RequestID: request.RequestID, Payload: payload}
+	return client.send(response)
+}
+
+var handleWhoAmIRequest = func(server *Server, client *connection, request protocol.Frame) {
+	userIDBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(userIDBytes, client.userID)
+	err := client.respond(request, protocol.FrameWhoAmIResponse, userIDBytes)
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+var handleWhoIsHereRequest = func(server *Server, client *connection, request protocol.Frame) {
 	var userIDs []uint64
 
-	server.connections.Range(func(userID, connection interface{}) bool {
-		conn := connection.(net.Conn)
-		if conn != clientConnection {
+	server.connections.Range(func(userID, value interface{}) bool {
+		if userID.(uint64) != client.userID {
 			userIDs = append(userIDs, userID.(uint64))
 		}
 		return true
 	})
 
-	var userIDsBuffer bytes.Buffer
-	gobBuffer := gob.NewEncoder(&userIDsBuffer)
-	err := gobBuffer.Encode(userIDs)
+	payload, err := protocol.EncodeUserIDs(client.codec, userIDs)
 	if err != nil {
-		fmt.Errorf("Error sending `who_is_here` response to client: %s", err.Error())
+		client.logger.Error("Encoding response failed", "message_type", request.Type.String(), "error", err)
 		return
 	}
 
-	_, err = clientConnection.Write([]byte{byte(len(userIDsBuffer.Bytes()))})
+	err = client.respond(request, protocol.FrameWhoIsHereResponse, payload)
+	if err == protocol.ErrFrameTooLarge {
+		client.sendError(request, protocol.ErrorLimitExceeded, "too many connected users to list")
+		return
+	}
 	if err != nil {
-		fmt.Errorf("Error sending `who_is_here` response to client: %s", err.Error())
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
 		return
 	}
+}
 
-	_, err = clientConnection.Write(userIDsBuffer.Bytes())
+// deliver queues a relayed message for a connected recipient and records the
+// outcome in the status.
+func (server *Server) deliver(recipient *connection, message protocol.Frame, status *protocol.RelayStatus) {
+	// Each recipient gets the message in the version it negotiated.
+	message.Version = recipient.version
+	err := recipient.relay(message)
+	if err == errSlowConsumer {
+		server.deregister(recipient, err)
+	}
 	if err != nil {
-		fmt.Errorf("Error sending `who_is_here` response to client: %s", err.Error())
+		recipient.logger.Warn("Relaying message failed", "message_type", message.Type.String(), "error", err)
+		if err == errSlowConsumer || err == errOutboundQueueFull {
+			server.metrics.messagesDropped.With("slow_consumer").Inc()
+		} else {
+			server.metrics.messagesDropped.With("failed").Inc()
+		}
+		status.Failed = append(status.Failed, recipient.userID)
 		return
 	}
+	server.metrics.messagesDelivered.Inc()
+	status.Delivered = append(status.Delivered, recipient.userID)
+}
+
+// relayMessage delivers the message to the connected receivers and stores it
+// for the others when there is a message store.
+func (server *Server) relayMessage(senderID uint64, receivers []uint64, body []byte) protocol.RelayStatus {
+	var status protocol.RelayStatus
+	message := protocol.Frame{Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(senderID, body)}
+	for _, receiver := range receivers {
+		value, ok := server.connections.Load(receiver)
+		if !ok {
+			value, ok = server.storeForOffline(receiver, senderID, body, &status)
+			if !ok {
+				continue
+			}
+		}
+
+		server.deliver(value.(*connection), message, &status)
+	}
+	server.metrics.observeFanOut(status)
+	return status
 }
 
-var handleRelayRequest = func(server *Server, clientConnection net.Conn) {
-	receiverListLengthBuffer := make([]byte, 1)
-	_, err := clientConnection.Read(receiverListLengthBuffer)
+// storeForOffline stores the message for a receiver that is not connected,
+// when the receiver is a user the hub handed out the ID to. It returns the
+// receiver's connection instead when the receiver connected meanwhile.
+func (server *Server) storeForOffline(receiver uint64, senderID uint64, body []byte, status *protocol.RelayStatus) (interface{}, bool) {
+	if server.store == nil || !server.issued.issued(receiver) {
+		server.metrics.messagesDropped.With("offline").Inc()
+		status.Offline = append(status.Offline, receiver)
+		return nil, false
+	}
+
+	lock := server.storeLock(receiver)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if value, ok := server.connections.Load(receiver); ok {
+		return value, true
+	}
+	err := server.store.Store(receiver, StoredMessage{SenderID: senderID, Body: body, StoredAt: time.Now()})
+	if err == ErrStoreFull {
+		server.logger.Warn("Message store is full", "user_id", receiver)
+		server.metrics.messagesDropped.With("store_full").Inc()
+		status.Failed = append(status.Failed, receiver)
+		return nil, false
+	}
 	if err != nil {
-		fmt.Errorf("Error in `relay` reading receiver list length: %s", err.Error())
+		server.logger.Error("Storing message for offline receiver failed", "user_id", receiver, "error", err)
+		server.metrics.messagesDropped.With("failed").Inc()
+		status.Failed = append(status.Failed, receiver)
+		return nil, false
+	}
+	status.Offline = append(status.Offline, receiver)
+	return nil, false
+}
+
+// checkMessageLength answers the request with an error when the body does not
+// fit in a `message` frame, which adds the sender ID to it.
+func checkMessageLength(sender *connection, request protocol.Frame, body []byte) bool {
+	if len(body) <= protocol.MaxMessageLength {
+		return true
+	}
+	sender.sendError(request, protocol.ErrorLimitExceeded, fmt.Sprintf("message exceeds %d bytes", protocol.MaxMessageLength))
+	return false
+}
+
+var handleRelayRequest = func(server *Server, sender *connection, request protocol.Frame) {
+	receivers, body, err := protocol.DecodeRelay(sender.codec, request.Payload)
+	if err == protocol.ErrTooManyRecipients {
+		sender.sendError(request, protocol.ErrorLimitExceeded,
+			fmt.Sprintf("relay is limited to %d recipients", protocol.MaxRecipients))
 		return
 	}
-	receiverListLength, err := binary.ReadUvarint(bytes.NewBuffer(receiverListLengthBuffer))
 	if err != nil {
-		fmt.Errorf("Error in `relay` incorrect receiver list length: %s", err.Error())
+		sender.logger.Warn("Malformed request", "message_type", request.Type.String(), "error", err)
+		sender.sendError(request, protocol.ErrorMalformedRequest, "malformed relay request")
+		return
+	}
+	if !checkMessageLength(sender, request, body) {
 		return
 	}
 
-	receiversBuffer := make([]byte, receiverListLength)
-	_, err = clientConnection.Read(receiversBuffer)
+	status := server.relayMessage(sender.userID, receivers, body)
+	payload, err := status.Encode(sender.codec)
 	if err != nil {
-		fmt.Errorf("Error in `relay` reading receivers list: %s", err.Error())
+		sender.logger.Error("Encoding relay status failed", "message_type", request.Type.String(), "error", err)
 		return
 	}
-	var receivers []uint64
-	gobBuffer := gob.NewDecoder(bytes.NewBuffer(receiversBuffer))
-	err = gobBuffer.Decode(&receivers)
+
+	err = sender.respond(request, protocol.FrameRelayStatus, payload)
 	if err != nil {
-		fmt.Errorf("Error in `relay` decoding receivers: %s", err.Error())
-		return
+		sender.logger.Warn("Sending relay status failed", "message_type", request.Type.String(), "error", err)
 	}
+}
 
-	messageLengthBuffer := make([]byte, 4)
-	_, err = clientConnection.Read(messageLengthBuffer)
+// handleBroadcastRequest relays the message to every connected user except
+// the sender and answers with a `relay_status` frame.
+var handleBroadcastRequest = func(server *Server, sender *connection, request protocol.Frame) {
+	body, err := protocol.DecodeBroadcast(request.Payload)
 	if err != nil {
-		fmt.Errorf("Error in `relay` reading message length: %s", err.Error())
+		sender.logger.Warn("Malformed request", "message_type", request.Type.String(), "error", err)
+		sender.sendError(request, protocol.ErrorMalformedRequest, "malformed broadcast request")
 		return
 	}
-	var messageLength uint32
-	messageLength = binary.LittleEndian.Uint32(messageLengthBuffer)
-	messageBuffer := make([]byte, messageLength)
-	_, err = clientConnection.Read(messageBuffer)
-	if err != nil {
-		fmt.Errorf("Error in `relay` reading message: %s", err.Error())
+	if !checkMessageLength(sender, request, body) {
 		return
 	}
 
-	var senderID uint64
-	server.connections.Range(func(userID, connection interface{}) bool {
-		conn := connection.(net.Conn)
-		if conn == clientConnection {
-			senderID = userID.(uint64)
-			return false
+	var status protocol.RelayStatus
+	message := protocol.Frame{Type: protocol.FrameMessage, Payload: protocol.EncodeMessage(sender.userID, body)}
+	server.connections.Range(func(userID, value interface{}) bool {
+		if userID.(uint64) != sender.userID {
+			server.deliver(value.(*connection), message, &status)
 		}
 		return true
 	})
 
-	for _, receiver := range receivers {
-		if connection, ok := server.connections.Load(receiver); ok {
-			conn := connection.(net.Conn)
-			senderIDBytes := make([]byte, 8)
-			binary.LittleEndian.PutUint64(senderIDBytes, senderID)
-			_, err := conn.Write(senderIDBytes)
-			if err != nil {
-				fmt.Errorf("Error relaying message to receiver %d: %s", receiver, err.Error())
-				return
-			}
+	server.metrics.observeFanOut(status)
 
-			_, err = conn.Write(messageLengthBuffer)
-			if err != nil {
-				fmt.Errorf("Error relaying message to receiver %d: %s", receiver, err.Error())
-				return
-			}
+	payload, err := status.Encode(sender.codec)
+	if err != nil {
+		sender.logger.Error("Encoding relay status failed", "message_type", request.Type.String(), "error", err)
+		return
+	}
 
-			_, err = conn.Write(messageBuffer)
-			if err != nil {
-				fmt.Errorf("Error relaying message to receiver %d: %s", receiver, err.Error())
-				return
-			}
-		}
+	err = sender.respond(request, protocol.FrameRelayStatus, payload)
+	if err != nil {
+		sender.logger.Warn("Sending relay status failed", "message_type", request.Type.String(), "error", err)
 	}
 }
@@ -2,19 +2,28 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"log/slog"
+	"message-delivery-system/internal/auth"
+	"message-delivery-system/internal/protocol"
+	"message-delivery-system/internal/utility"
 	"net"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type ServerTestSuite struct {
 	suite.Suite
 	server                *Server
+	serverAddr            net.TCPAddr
 	clientConnectionOne   net.Conn
 	clientConnectionTwo   net.Conn
 	clientConnectionThree net.Conn
@@ -26,157 +35,269 @@ type ServerTestSuite struct {
 func (s *ServerTestSuite) SetupSuite() {
 	serverPort := 9001
 	s.server = New()
-	serverAddr := net.TCPAddr{Port: serverPort}
-	require.NoError(s.T(), s.server.Start(&serverAddr), "should not return error on server start")
+	s.serverAddr = net.TCPAddr{Port: serverPort}
+	require.NoError(s.T(), s.server.Start(&s.serverAddr), "should not return error on server start")
 
 	var err error
-	s.clientConnectionOne, err = net.Dial("tcp", serverAddr.String())
+	s.clientConnectionOne, s.userIDOne, err = dialAndHandshake(&s.serverAddr)
 	assert.NoError(s.T(), err, "should not return error while connecting to server")
 
-	s.clientConnectionTwo, err = net.Dial("tcp", serverAddr.String())
+	s.clientConnectionTwo, s.userIDTwo, err = dialAndHandshake(&s.serverAddr)
 	assert.NoError(s.T(), err, "should not return error while connecting to server")
 
-	s.clientConnectionThree, err = net.Dial("tcp", serverAddr.String())
+	s.clientConnectionThree, s.userIDThree, err = dialAndHandshake(&s.serverAddr)
 	assert.NoError(s.T(), err, "should not return error while connecting to server")
+}
 
-	s.userIDOne, err = getUserID(s.clientConnectionOne)
-	assert.NoError(s.T(), err, "should not return error while getting userID from server")
-	s.userIDTwo, err = getUserID(s.clientConnectionTwo)
-	assert.NoError(s.T(), err, "should not return error while getting userID from server")
-	s.userIDThree, err = getUserID(s.clientConnectionThree)
-	assert.NoError(s.T(), err, "should not return error while getting userID from server")
+func dialAndHandshake(serverAddr *net.TCPAddr) (net.Conn, uint64, error) {
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	clientConnection, welcome, err := dialWithHello(serverAddr, hello)
+	return clientConnection, welcome.UserID, err
 }
 
-func getUserID(clientConnection net.Conn) (uint64, error) {
-	var userID uint64
-	messageType := "who_am_i"
-	messageTypeLength := len(messageType)
+func dialWithHello(serverAddr *net.TCPAddr, hello protocol.Hello) (net.Conn, protocol.Welcome, error) {
+	var welcome protocol.Welcome
+	clientConnection, err := net.Dial("tcp", serverAddr.String())
+	if err != nil {
+		return nil, welcome, err
+	}
 
-	_, err := clientConnection.Write([]byte{byte(messageTypeLength)})
+	err = protocol.WriteFrame(clientConnection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameHello, Payload: hello.Encode()})
 	if err != nil {
-		return userID, err
+		return nil, welcome, err
 	}
 
-	_, err = clientConnection.Write([]byte(messageType))
+	response, err := protocol.ReadFrame(clientConnection)
 	if err != nil {
-		return userID, err
+		return nil, welcome, err
 	}
 
-	userIDBuffer := make([]byte, 8)
-	_, err = clientConnection.Read(userIDBuffer)
+	welcome, err = protocol.DecodeWelcome(response.Payload)
 	if err != nil {
-		return userID, err
+		return nil, welcome, err
 	}
 
-	userID = binary.LittleEndian.Uint64(userIDBuffer)
-	return userID, nil
+	return clientConnection, welcome, nil
 }
 
-func (s *ServerTestSuite) TestWhoAmIRequest() {
-	messageType := "who_am_i"
-	messageTypeLength := len(messageType)
-
-	_, err := s.clientConnectionOne.Write([]byte{byte(messageTypeLength)})
-	assert.NoError(s.T(), err, "should not return error while writing messageTypeLength to server")
+func writeRequest(clientConnection net.Conn, requestType protocol.FrameType, requestID uint32, payload []byte) error {
+	return protocol.WriteFrame(clientConnection, protocol.Frame{Version: protocol.Version, Type: requestType, RequestID: requestID, Payload: payload})
+}
 
-	_, err = s.clientConnectionOne.Write([]byte(messageType))
-	assert.NoError(s.T(), err, "should not return error while writing messageType to server")
+func (s *ServerTestSuite) TestWhoAmIRequest() {
+	err := writeRequest(s.clientConnectionOne, protocol.FrameWhoAmI, 1, nil)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
 
-	expectedUserIDBytes := 8
-	userIDBuffer := make([]byte, 1024)
-	userIDBytes, err := s.clientConnectionOne.Read(userIDBuffer)
+	response, err := protocol.ReadFrame(s.clientConnectionOne)
 	assert.NoError(s.T(), err, "should not return error while reading userID from server")
 
-	userID := binary.LittleEndian.Uint64(userIDBuffer)
+	expectedUserIDBytes := 8
+	userID := binary.LittleEndian.Uint64(response.Payload)
 
-	assert.Equal(s.T(), expectedUserIDBytes, userIDBytes)
+	assert.Equal(s.T(), protocol.FrameWhoAmIResponse, response.Type)
+	assert.Equal(s.T(), uint32(1), response.RequestID)
+	assert.Equal(s.T(), expectedUserIDBytes, len(response.Payload))
 	assert.Equal(s.T(), reflect.Uint64, reflect.TypeOf(userID).Kind())
+	assert.Equal(s.T(), s.userIDOne, userID)
 }
 
 func (s *ServerTestSuite) TestListClientIDsRequest() {
-	messageType := "who_is_here"
-	messageTypeLength := len(messageType)
-
-	_, err := s.clientConnectionOne.Write([]byte{byte(messageTypeLength)})
-	assert.NoError(s.T(), err, "should not return error while writing messageTypeLength to server")
+	err := writeRequest(s.clientConnectionOne, protocol.FrameWhoIsHere, 2, nil)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
 
-	_, err = s.clientConnectionOne.Write([]byte(messageType))
-	assert.NoError(s.T(), err, "should not return error while writing messageType to server")
-
-	expectedUserIDsLength := 2
-	userIDsLengthBuffer := make([]byte, 1)
-	_, err = s.clientConnectionOne.Read(userIDsLengthBuffer)
-	assert.NoError(s.T(), err, "should not return error while reading UserIdsLength from server")
-
-	userIDsLength, err := binary.ReadUvarint(bytes.NewBuffer(userIDsLengthBuffer))
-	assert.NoError(s.T(), err, "should not return error while decoding UserIdsLength")
-
-	userIDsBuffer := make([]byte, userIDsLength)
-	_, err = s.clientConnectionOne.Read(userIDsBuffer)
+	response, err := protocol.ReadFrame(s.clientConnectionOne)
 	assert.NoError(s.T(), err, "should not return error while reading UserIDs from server")
+	assert.Equal(s.T(), protocol.FrameWhoIsHereResponse, response.Type)
+	assert.Equal(s.T(), uint32(2), response.RequestID)
 
-	var userIDs []uint64
-	gobBuffer := gob.NewDecoder(bytes.NewBuffer(userIDsBuffer))
-	err = gobBuffer.Decode(&userIDs)
+	userIDs, err := protocol.DecodeUserIDs(protocol.LittleEndian, response.Payload)
 	assert.NoError(s.T(), err, "should not return error while decoding UserIDs")
 
+	expectedUserIDsLength := 2
 	assert.Equal(s.T(), expectedUserIDsLength, len(userIDs))
 	assert.ElementsMatch(s.T(), []uint64{s.userIDTwo, s.userIDThree}, userIDs)
 }
 
 func (s *ServerTestSuite) TestRelayRequest() {
-	messageType := "relay"
-	messageTypeLength := len(messageType)
+	message := "Hello recipient!"
+	offlineUserID := uint64(12345)
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{s.userIDTwo, offlineUserID}, []byte(message))
+	require.NoError(s.T(), err, "should not return error while encoding relay request")
 
-	_, err := s.clientConnectionOne.Write([]byte{byte(messageTypeLength)})
-	assert.NoError(s.T(), err, "should not return error while writing messageTypeLength to server")
+	err = writeRequest(s.clientConnectionOne, protocol.FrameRelay, 3, payload)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
 
-	_, err = s.clientConnectionOne.Write([]byte(messageType))
-	assert.NoError(s.T(), err, "should not return error while writing messageType to server")
+	incoming, err := protocol.ReadFrame(s.clientConnectionTwo)
+	assert.NoError(s.T(), err, "should not return error while reading recipient message from server")
+	assert.Equal(s.T(), protocol.FrameMessage, incoming.Type)
 
-	recipients := []uint64{s.userIDTwo}
-	var recipientsBuffer bytes.Buffer
-	gobBuffer := gob.NewEncoder(&recipientsBuffer)
-	require.NoError(s.T(), gobBuffer.Encode(recipients), "should not return error while encoding recipients")
+	senderID, body, err := protocol.DecodeMessage(incoming.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding recipient message")
+	assert.Equal(s.T(), s.userIDOne, senderID)
+	assert.Equal(s.T(), message, string(body))
+
+	response, err := protocol.ReadFrame(s.clientConnectionOne)
+	assert.NoError(s.T(), err, "should not return error while reading relay status from server")
+	assert.Equal(s.T(), protocol.FrameRelayStatus, response.Type)
+	assert.Equal(s.T(), uint32(3), response.RequestID)
+
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding relay status")
+	assert.Equal(s.T(), []uint64{s.userIDTwo}, status.Delivered)
+	assert.Equal(s.T(), []uint64{offlineUserID}, status.Offline)
+	assert.Empty(s.T(), status.Failed)
+}
 
-	_, err = s.clientConnectionOne.Write([]byte{byte(len(recipientsBuffer.Bytes()))})
-	assert.NoError(s.T(), err, "should not return error while writing number of recipients to server")
+func (s *ServerTestSuite) TestBroadcastRequest() {
+	body := []byte("to everyone")
+	require.NoError(s.T(), writeRequest(s.clientConnectionOne, protocol.FrameBroadcast, 1, protocol.EncodeBroadcast(body)))
+
+	for _, clientConnection := range []net.Conn{s.clientConnectionTwo, s.clientConnectionThree} {
+		message, err := protocol.ReadFrame(clientConnection)
+		require.NoError(s.T(), err)
+		assert.Equal(s.T(), protocol.FrameMessage, message.Type)
+		senderID, messageBody, err := protocol.DecodeMessage(message.Payload)
+		require.NoError(s.T(), err)
+		assert.Equal(s.T(), s.userIDOne, senderID)
+		assert.Equal(s.T(), body, messageBody)
+	}
 
-	_, err = s.clientConnectionOne.Write(recipientsBuffer.Bytes())
-	assert.NoError(s.T(), err, "should not return error while writing recipients to server")
+	response, err := protocol.ReadFrame(s.clientConnectionOne)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), protocol.FrameRelayStatus, response.Type, "the sender should not get its own broadcast")
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	require.NoError(s.T(), err)
+	assert.ElementsMatch(s.T(), []uint64{s.userIDTwo, s.userIDThree}, status.Delivered)
+}
 
-	message := "Hello recipient!"
-	body := []byte(message)
-	var messageLength uint32
-	messageLength = uint32(len(body))
+func (s *ServerTestSuite) TestBroadcastRequestWithTooLongBody() {
+	// The request fits in a frame, but the relayed message would not.
+	body := make([]byte, protocol.MaxMessageLength+1)
+	require.NoError(s.T(), writeRequest(s.clientConnectionOne, protocol.FrameBroadcast, 1, protocol.EncodeBroadcast(body)))
+
+	response, err := protocol.ReadFrame(s.clientConnectionOne)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), protocol.ErrorLimitExceeded, protocolError.Code)
+
+	// The body that fits is relayed.
+	body = body[:protocol.MaxMessageLength]
+	require.NoError(s.T(), writeRequest(s.clientConnectionOne, protocol.FrameBroadcast, 2, protocol.EncodeBroadcast(body)))
+	for _, clientConnection := range []net.Conn{s.clientConnectionTwo, s.clientConnectionThree} {
+		message, err := protocol.ReadFrame(clientConnection)
+		require.NoError(s.T(), err)
+		_, messageBody, err := protocol.DecodeMessage(message.Payload)
+		require.NoError(s.T(), err)
+		assert.Len(s.T(), messageBody, protocol.MaxMessageLength)
+	}
+	response, err = protocol.ReadFrame(s.clientConnectionOne)
+	require.NoError(s.T(), err)
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	require.NoError(s.T(), err)
+	assert.ElementsMatch(s.T(), []uint64{s.userIDTwo, s.userIDThree}, status.Delivered)
+}
 
-	msgLengthBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(msgLengthBytes, messageLength)
-	_, err = s.clientConnectionOne.Write(msgLengthBytes)
-	assert.NoError(s.T(), err, "should not return error while writing messageLength to server")
+func (s *ServerTestSuite) TestRelayRequestWithTooManyRecipients() {
+	receivers, err := protocol.LittleEndian.EncodeUserIDs(make([]uint64, protocol.MaxRecipients+1))
+	require.NoError(s.T(), err, "should not return error while encoding recipients")
 
-	_, err = s.clientConnectionOne.Write(body)
-	assert.NoError(s.T(), err, "should not return error while writing message to server")
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(len(receivers)))
+	payload = append(payload, receivers...)
+	payload = append(payload, 0, 0, 0, 0)
 
-	senderIDBuffer := make([]byte, 8)
-	_, err = s.clientConnectionTwo.Read(senderIDBuffer)
-	assert.NoError(s.T(), err, "should not return error while reading recipient message - senderID from server")
+	err = writeRequest(s.clientConnectionThree, protocol.FrameRelay, 5, payload)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
 
-	senderID := binary.LittleEndian.Uint64(senderIDBuffer)
-	assert.Equal(s.T(), s.userIDOne, senderID)
+	response, err := protocol.ReadFrame(s.clientConnectionThree)
+	assert.NoError(s.T(), err, "should not return error while reading error frame from server")
+	assert.Equal(s.T(), protocol.FrameError, response.Type)
+	assert.Equal(s.T(), uint32(5), response.RequestID)
 
-	messageLengthBuffer := make([]byte, 4)
-	_, err = s.clientConnectionTwo.Read(messageLengthBuffer)
-	assert.NoError(s.T(), err, "should not return error while reading recipient message - length from server")
+	protocolError, err := protocol.DecodeError(response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding error frame")
+	assert.Equal(s.T(), protocol.ErrorLimitExceeded, protocolError.Code)
 
-	msgLength, err := binary.ReadUvarint(bytes.NewBuffer(messageLengthBuffer))
-	assert.NoError(s.T(), err, "should not return error while reading recipient message from server")
+	// The connection is still usable after the rejected request.
+	err = writeRequest(s.clientConnectionThree, protocol.FrameWhoAmI, 6, nil)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
+	response, err = protocol.ReadFrame(s.clientConnectionThree)
+	assert.NoError(s.T(), err, "should not return error while reading userID from server")
+	assert.Equal(s.T(), protocol.FrameWhoAmIResponse, response.Type)
+	assert.Equal(s.T(), s.userIDThree, binary.LittleEndian.Uint64(response.Payload))
+}
 
-	messageBuffer := make([]byte, msgLength)
-	_, err = s.clientConnectionTwo.Read(messageBuffer)
-	assert.NoError(s.T(), err, "should not return error while reading recipient message from server")
+func (s *ServerTestSuite) TestUnknownMessageType() {
+	err := writeRequest(s.clientConnectionThree, protocol.FrameType(200), 4, nil)
+	assert.NoError(s.T(), err, "should not return error while writing request to server")
+
+	response, err := protocol.ReadFrame(s.clientConnectionThree)
+	assert.NoError(s.T(), err, "should not return error while reading error frame from server")
+	assert.Equal(s.T(), protocol.FrameError, response.Type)
+	assert.Equal(s.T(), uint32(4), response.RequestID)
+
+	protocolError, err := protocol.DecodeError(response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding error frame")
+	assert.Equal(s.T(), protocol.ErrorUnknownFrameType, protocolError.Code)
+}
 
-	assert.Equal(s.T(), message, string(messageBuffer))
+func (s *ServerTestSuite) TestLegacyClientIsRejected() {
+	clientConnection, err := net.Dial("tcp", s.serverAddr.String())
+	require.NoError(s.T(), err, "should not return error while connecting to server")
+	defer clientConnection.Close()
+
+	messageType := "who_am_i"
+	_, err = clientConnection.Write(append([]byte{byte(len(messageType))}, messageType...))
+	assert.NoError(s.T(), err, "should not return error while writing legacy request to server")
+
+	response, err := protocol.ReadFrame(clientConnection)
+	assert.NoError(s.T(), err, "should not return error while reading error frame from server")
+	assert.Equal(s.T(), protocol.FrameError, response.Type)
+
+	protocolError, err := protocol.DecodeError(response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding error frame")
+	assert.Equal(s.T(), protocol.ErrorUnsupportedProtocol, protocolError.Code)
+
+	_, err = protocol.ReadFrame(clientConnection)
+	assert.Error(s.T(), err, "server should close the legacy connection")
+}
+
+func (s *ServerTestSuite) TestUnsupportedVersionIsRejected() {
+	clientConnection, err := net.Dial("tcp", s.serverAddr.String())
+	require.NoError(s.T(), err, "should not return error while connecting to server")
+	defer clientConnection.Close()
+
+	hello := protocol.Hello{MinVersion: protocol.Version + 1, MaxVersion: protocol.Version + 2}
+	err = protocol.WriteFrame(clientConnection, protocol.Frame{Version: protocol.Version + 1, Type: protocol.FrameHello, Payload: hello.Encode()})
+	assert.NoError(s.T(), err, "should not return error while writing hello to server")
+
+	response, err := protocol.ReadFrame(clientConnection)
+	assert.NoError(s.T(), err, "should not return error while reading error frame from server")
+	assert.Equal(s.T(), protocol.FrameError, response.Type)
+
+	protocolError, err := protocol.DecodeError(response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding error frame")
+	assert.Equal(s.T(), protocol.ErrorUnsupportedVersion, protocolError.Code)
+}
+
+func (s *ServerTestSuite) TestUnsupportedCodecIsRejected() {
+	clientConnection, err := net.Dial("tcp", s.serverAddr.String())
+	require.NoError(s.T(), err, "should not return error while connecting to server")
+	defer clientConnection.Close()
+
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version, Codec: "msgpack"}
+	err = protocol.WriteFrame(clientConnection, protocol.Frame{Version: protocol.Version, Type: protocol.FrameHello, Payload: hello.Encode()})
+	assert.NoError(s.T(), err, "should not return error while writing hello to server")
+
+	response, err := protocol.ReadFrame(clientConnection)
+	assert.NoError(s.T(), err, "should not return error while reading error frame from server")
+	assert.Equal(s.T(), protocol.FrameError, response.Type)
+
+	protocolError, err := protocol.DecodeError(response.Payload)
+	assert.NoError(s.T(), err, "should not return error while decoding error frame")
+	assert.Equal(s.T(), protocol.ErrorUnsupportedCodec, protocolError.Code)
 }
 
 func (s *ServerTestSuite) TearDownSuite() {
@@ -186,6 +307,372 @@ func (s *ServerTestSuite) TearDownSuite() {
 	require.NoError(s.T(), s.clientConnectionThree.Close())
 }
 
+func TestOfflineMessagesAreFlushedOnConnect(t *testing.T) {
+	srv := New()
+	srv.SetMessageStore(NewMemoryStore(time.Minute))
+	nextUserIDs := []uint64{200, 100}
+	srv.generateID = func() uint64 {
+		userID := nextUserIDs[0]
+		nextUserIDs = nextUserIDs[1:]
+		return userID
+	}
+	serverAddr := net.TCPAddr{Port: 9010}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	receiver, welcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), welcome.UserID)
+	require.NoError(t, receiver.Close())
+	require.Eventually(t, func() bool { return !srv.isConnected(200) }, time.Second, time.Millisecond)
+
+	sender, senderID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer sender.Close()
+	require.Equal(t, uint64(100), senderID)
+
+	for _, message := range []string{"first", "second"} {
+		payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{200}, []byte(message))
+		require.NoError(t, err)
+		require.NoError(t, writeRequest(sender, protocol.FrameRelay, 1, payload))
+
+		response, err := protocol.ReadFrame(sender)
+		require.NoError(t, err)
+		status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{200}, status.Offline)
+	}
+
+	hello.SessionToken = welcome.SessionToken
+	receiver, welcome, err = dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer receiver.Close()
+	require.True(t, welcome.Resumed)
+
+	for _, expected := range []string{"first", "second"} {
+		incoming, err := protocol.ReadFrame(receiver)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.FrameMessage, incoming.Type)
+
+		messageSenderID, body, err := protocol.DecodeMessage(incoming.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, senderID, messageSenderID)
+		assert.Equal(t, expected, string(body))
+	}
+}
+
+func TestMessagesAreStoredOnlyForIssuedUsers(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	srv := New()
+	srv.SetMessageStore(store)
+	serverAddr := net.TCPAddr{Port: 9037}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	sender, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer sender.Close()
+
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{12345}, []byte("unknown"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(sender, protocol.FrameRelay, 1, payload))
+	response, err := protocol.ReadFrame(sender)
+	require.NoError(t, err)
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{12345}, status.Offline)
+
+	messages, err := store.Flush(12345)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "messages for IDs the hub never issued should not be stored")
+}
+
+func TestSweepForgetsUsersGoneForTheTTL(t *testing.T) {
+	srv := New()
+	srv.SetMessageStore(NewMemoryStore(time.Minute))
+	srv.issued.touch(1)
+	srv.connections.Store(uint64(2), &connection{userID: 2})
+	srv.issued.touch(2)
+
+	srv.sweep(time.Now())
+	assert.True(t, srv.issued.issued(1))
+
+	srv.sweep(time.Now().Add(2 * time.Minute))
+	assert.False(t, srv.issued.issued(1), "messages should no longer be stored for a user gone for the TTL")
+	assert.True(t, srv.issued.issued(2), "connected users should be kept")
+}
+
+func TestSessionResumption(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9011}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	firstConnection, firstWelcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer firstConnection.Close()
+	assert.False(t, firstWelcome.Resumed)
+	assert.NotEmpty(t, firstWelcome.SessionToken)
+
+	hello.SessionToken = firstWelcome.SessionToken
+	secondConnection, secondWelcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer secondConnection.Close()
+	assert.True(t, secondWelcome.Resumed)
+	assert.Equal(t, firstWelcome.UserID, secondWelcome.UserID)
+	assert.Equal(t, firstWelcome.SessionToken, secondWelcome.SessionToken)
+	assert.Equal(t, []uint64{firstWelcome.UserID}, srv.ListClientIDs())
+
+	_, err = protocol.ReadFrame(firstConnection)
+	assert.Error(t, err, "the stale connection of a resumed session should be closed")
+
+	hello.SessionToken = "unknown"
+	thirdConnection, thirdWelcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer thirdConnection.Close()
+	assert.False(t, thirdWelcome.Resumed)
+	assert.NotEqual(t, firstWelcome.UserID, thirdWelcome.UserID)
+}
+
+func TestAuthentication(t *testing.T) {
+	key := []byte("signing-key")
+	srv := New()
+	srv.SetAuthenticator(auth.NewHMACAuthenticator(key))
+	serverAddr := net.TCPAddr{Port: 9012}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	for _, credentials := range [][]byte{nil, []byte("forged"), auth.SignHMACToken(key, "alice", time.Now().Add(-time.Minute))} {
+		clientConnection, err := net.Dial("tcp", serverAddr.String())
+		require.NoError(t, err)
+
+		hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version, Credentials: credentials}
+		require.NoError(t, writeRequest(clientConnection, protocol.FrameHello, 0, hello.Encode()))
+
+		response, err := protocol.ReadFrame(clientConnection)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.FrameError, response.Type)
+		protocolError, err := protocol.DecodeError(response.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.ErrorUnauthorized, protocolError.Code)
+
+		_, err = protocol.ReadFrame(clientConnection)
+		assert.Error(t, err, "the unauthenticated connection should be closed")
+		clientConnection.Close()
+	}
+	assert.Empty(t, srv.ListClientIDs(), "unauthenticated connections should not be registered")
+
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version, Credentials: auth.SignHMACToken(key, "alice", time.Now().Add(time.Minute))}
+	clientConnection, welcome, err := dialWithHello(&serverAddr, hello)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	assert.Equal(t, utility.GenerateIDFromSubject("alice"), welcome.UserID)
+	assert.Equal(t, []uint64{welcome.UserID}, srv.ListClientIDs())
+}
+
+// blockingStore keeps relays to offline recipients in flight until released.
+type blockingStore struct {
+	storing chan struct{}
+	release chan struct{}
+}
+
+func (store *blockingStore) Store(recipientID uint64, message StoredMessage) error {
+	store.storing <- struct{}{}
+	<-store.release
+	return nil
+}
+
+func (store *blockingStore) Flush(recipientID uint64) ([]StoredMessage, error) {
+	return nil, nil
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9021}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	current, welcome, err := dialWithHello(&serverAddr, protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version})
+	require.NoError(t, err)
+	defer current.Close()
+	assert.Equal(t, protocol.LittleEndian.Name(), welcome.Codec, "version 2 should default to little-endian user IDs")
+
+	legacy, welcome, err := dialWithHello(&serverAddr, protocol.Hello{MinVersion: 1, MaxVersion: 1})
+	require.NoError(t, err)
+	defer legacy.Close()
+	assert.Equal(t, byte(1), welcome.Version)
+	assert.Equal(t, protocol.Gob.Name(), welcome.Codec, "version 1 should keep gob")
+
+	require.NoError(t, writeRequest(legacy, protocol.FrameWhoIsHere, 1, nil))
+	response, err := protocol.ReadFrame(legacy)
+	require.NoError(t, err)
+	userIDs, err := protocol.DecodeUserIDs(protocol.Gob, response.Payload)
+	require.NoError(t, err, "version 1 clients should get gob-encoded user IDs")
+	assert.Len(t, userIDs, 1)
+}
+
+func TestOversizedHello(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9036}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	clientConnection, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer clientConnection.Close()
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version, Credentials: make([]byte, protocol.MaxHelloLength)}
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameHello, 0, hello.Encode()))
+
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ErrorLimitExceeded, protocolError.Code)
+}
+
+// logBuffer collects the JSON lines of a slog.JSONHandler written from many
+// goroutines.
+type logBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (logs *logBuffer) Write(p []byte) (int, error) {
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+	return logs.buffer.Write(p)
+}
+
+// find returns the first record with the message.
+func (logs *logBuffer) find(message string) (map[string]interface{}, bool) {
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+
+	decoder := json.NewDecoder(bytes.NewReader(logs.buffer.Bytes()))
+	for decoder.More() {
+		var record map[string]interface{}
+		if decoder.Decode(&record) != nil {
+			return nil, false
+		}
+		if record["msg"] == message {
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+func TestLogging(t *testing.T) {
+	logs := &logBuffer{}
+	srv := New()
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv.SetLogger(logger)
+	assert.Same(t, logger, srv.Logger())
+	serverAddr := net.TCPAddr{Port: 9027}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	clientConnection, userID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameRelay, 1, []byte{1}))
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameError, response.Type)
+	clientConnection.Close()
+
+	require.Eventually(t, func() bool {
+		_, ok := logs.find("Client disconnected")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	connected, ok := logs.find("Client connected")
+	require.True(t, ok)
+	assert.Equal(t, "INFO", connected["level"])
+	assert.Equal(t, float64(userID), connected["user_id"])
+	connectionID := connected["connection_id"]
+	assert.NotNil(t, connectionID)
+
+	received, ok := logs.find("Received request")
+	require.True(t, ok)
+	assert.Equal(t, "DEBUG", received["level"])
+	assert.Equal(t, protocol.FrameRelay.String(), received["message_type"])
+
+	malformed, ok := logs.find("Malformed request")
+	require.True(t, ok, "errors should be logged")
+	assert.Equal(t, "WARN", malformed["level"])
+	assert.Equal(t, connectionID, malformed["connection_id"])
+	assert.Equal(t, float64(userID), malformed["user_id"])
+	assert.Equal(t, protocol.FrameRelay.String(), malformed["message_type"])
+	assert.NotEmpty(t, malformed["error"])
+}
+
+func TestShutdownDrainsInFlightRelays(t *testing.T) {
+	store := &blockingStore{storing: make(chan struct{}, 1), release: make(chan struct{})}
+	srv := New()
+	srv.SetMessageStore(store)
+	srv.issued.touch(12345)
+	serverAddr := net.TCPAddr{Port: 9013}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	clientConnection, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{12345}, []byte("in flight"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameRelay, 1, payload))
+	<-store.storing
+
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	goingAway, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameGoingAway, goingAway.Type)
+
+	close(store.release)
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err, "the in-flight relay should be answered")
+	assert.Equal(t, protocol.FrameRelayStatus, response.Type)
+	assert.Equal(t, uint32(1), response.RequestID)
+
+	assert.NoError(t, <-shutdownErr)
+	_, err = protocol.ReadFrame(clientConnection)
+	assert.Error(t, err, "the connection should be closed after the drain")
+	_, err = net.Dial("tcp", serverAddr.String())
+	assert.Error(t, err, "the listener should be closed")
+}
+
+func TestShutdownReturnsWhenContextExpires(t *testing.T) {
+	store := &blockingStore{storing: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(store.release)
+	srv := New()
+	srv.SetMessageStore(store)
+	srv.issued.touch(12345)
+	serverAddr := net.TCPAddr{Port: 9014}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	clientConnection, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{12345}, []byte("stuck"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameRelay, 1, payload))
+	<-store.storing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+}
+
 func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerTestSuite))
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSessionGracePeriod = 5 * time.Minute
+
+type session struct {
+	token    string
+	userID   uint64
+	lastSeen time.Time
+}
+
+// sessionRegistry maps resumable session tokens to user IDs. A session stays
+// valid while its user is connected and for the grace period after the user
+// was last seen.
+type sessionRegistry struct {
+	gracePeriod time.Duration
+	byToken     map[string]*session
+	byUserID    map[uint64]*session
+	mutex       sync.Mutex
+}
+
+func newSessionRegistry(gracePeriod time.Duration) *sessionRegistry {
+	return &sessionRegistry{
+		gracePeriod: gracePeriod,
+		byToken:     make(map[string]*session),
+		byUserID:    make(map[uint64]*session),
+	}
+}
+
+func (registry *sessionRegistry) setGracePeriod(gracePeriod time.Duration) {
+	registry.mutex.Lock()
+	registry.gracePeriod = gracePeriod
+	registry.mutex.Unlock()
+}
+
+func (registry *sessionRegistry) create(token string, userID uint64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	// A user has one session; the token of the one replaced is no longer
+	// valid.
+	if previous, ok := registry.byUserID[userID]; ok {
+		delete(registry.byToken, previous.token)
+	}
+	userSession := &session{token: token, userID: userID, lastSeen: time.Now()}
+	registry.byToken[token] = userSession
+	registry.byUserID[userID] = userSession
+}
+
+// resume returns the user ID of the session if it has not expired.
+func (registry *sessionRegistry) resume(token string, isConnected func(userID uint64) bool) (uint64, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	userSession, ok := registry.byToken[token]
+	if !ok {
+		return 0, false
+	}
+	now := time.Now()
+	if registry.expired(userSession, now, isConnected) {
+		registry.remove(userSession)
+		return 0, false
+	}
+	userSession.lastSeen = now
+	return userSession.userID, true
+}
+
+// touch records activity of the user so its session does not expire.
+func (registry *sessionRegistry) touch(userID uint64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if userSession, ok := registry.byUserID[userID]; ok {
+		userSession.lastSeen = time.Now()
+	}
+}
+
+// has tells whether the user has a session.
+func (registry *sessionRegistry) has(userID uint64) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	_, ok := registry.byUserID[userID]
+	return ok
+}
+
+// expire drops the sessions of users that are not connected and were last
+// seen longer than the grace period before now. The server calls it every
+// sweep interval.
+func (registry *sessionRegistry) expire(now time.Time, isConnected func(userID uint64) bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for _, userSession := range registry.byToken {
+		if registry.expired(userSession, now, isConnected) {
+			registry.remove(userSession)
+		}
+	}
+}
+
+// expired tells whether the session is over. The caller must hold the mutex.
+func (registry *sessionRegistry) expired(userSession *session, now time.Time, isConnected func(userID uint64) bool) bool {
+	return !isConnected(userSession.userID) && now.Sub(userSession.lastSeen) > registry.gracePeriod
+}
+
+// remove drops the session. The caller must hold the mutex.
+func (registry *sessionRegistry) remove(userSession *session) {
+	delete(registry.byToken, userSession.token)
+	delete(registry.byUserID, userSession.userID)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistryResume(t *testing.T) {
+	registry := newSessionRegistry(time.Minute)
+	registry.create("token", 42)
+
+	userID, ok := registry.resume("token", func(uint64) bool { return false })
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), userID)
+
+	_, ok = registry.resume("unknown", func(uint64) bool { return false })
+	assert.False(t, ok)
+}
+
+func TestSessionRegistryExpiresUnusedSessions(t *testing.T) {
+	gracePeriod := 20 * time.Millisecond
+	registry := newSessionRegistry(gracePeriod)
+	registry.create("connected", 1)
+	registry.create("disconnected", 2)
+	isConnected := func(userID uint64) bool { return userID == 1 }
+
+	time.Sleep(2 * gracePeriod)
+
+	_, ok := registry.resume("disconnected", isConnected)
+	assert.False(t, ok, "session of a user gone for longer than the grace period should expire")
+
+	userID, ok := registry.resume("connected", isConnected)
+	assert.True(t, ok, "session of a connected user should not expire")
+	assert.Equal(t, uint64(1), userID)
+}
+
+func TestSessionRegistryTouchKeepsSessionAlive(t *testing.T) {
+	gracePeriod := 40 * time.Millisecond
+	registry := newSessionRegistry(gracePeriod)
+	registry.create("token", 7)
+	isConnected := func(uint64) bool { return false }
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(gracePeriod / 2)
+		registry.touch(7)
+	}
+
+	_, ok := registry.resume("token", isConnected)
+	assert.True(t, ok)
+}
+
+func TestSessionRegistryExpireDropsUnusedSessions(t *testing.T) {
+	registry := newSessionRegistry(time.Minute)
+	registry.create("connected", 1)
+	registry.create("disconnected", 2)
+	isConnected := func(userID uint64) bool { return userID == 1 }
+
+	registry.expire(time.Now().Add(2*time.Minute), isConnected)
+
+	assert.NotContains(t, registry.byToken, "disconnected")
+	assert.NotContains(t, registry.byUserID, uint64(2))
+	assert.Contains(t, registry.byToken, "connected")
+}
+
+func TestSessionRegistryCreateReplacesSession(t *testing.T) {
+	registry := newSessionRegistry(time.Minute)
+	registry.create("old", 42)
+	registry.create("new", 42)
+	isConnected := func(uint64) bool { return false }
+
+	_, ok := registry.resume("old", isConnected)
+	assert.False(t, ok, "the token of a replaced session should not resume")
+	assert.Len(t, registry.byToken, 1)
+
+	userID, ok := registry.resume("new", isConnected)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), userID)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SlowConsumerAction is what the hub does with a relayed message when the
+// recipient's outbound queue is full.
+type SlowConsumerAction int
+
+const (
+	// DropNewest drops the message being relayed and reports the recipient as failed.
+	DropNewest SlowConsumerAction = iota
+	// DropOldest drops the oldest queued relayed frame to make room for the
+	// message. Answers to the client's requests and the hub's own frames are
+	// never dropped.
+	DropOldest
+	// Disconnect drops the message and disconnects the recipient once
+	// Threshold messages in a row were dropped.
+	Disconnect
+	// BlockWithTimeout makes the sender wait up to Timeout for room in the
+	// queue before dropping the message. Presence events, which have no
+	// sender, are dropped at once.
+	BlockWithTimeout
+)
+
+func (action SlowConsumerAction) String() string {
+	switch action {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	case BlockWithTimeout:
+		return "block-with-timeout"
+	}
+	return "unknown"
+}
+
+// SlowConsumerPolicy configures how relays to a client that does not keep up
+// are handled.
+type SlowConsumerPolicy struct {
+	Action SlowConsumerAction
+	// Threshold is the number of messages dropped in a row before a
+	// Disconnect policy disconnects the client. Zero disconnects on the first.
+	Threshold int
+	// Timeout is how long a BlockWithTimeout policy waits for room in the queue.
+	Timeout time.Duration
+}
+
+// SlowConsumerStats counts the messages a user lost because it did not keep up.
+type SlowConsumerStats struct {
+	UserID uint64
+	// Dropped counts relayed messages that were not queued, or were evicted
+	// from the queue by a DropOldest policy.
+	Dropped uint64
+	// Disconnects counts the times a Disconnect policy disconnected the user.
+	Disconnects uint64
+}
+
+type slowConsumerCounters struct {
+	dropped     uint64
+	disconnects uint64
+}
+
+// SlowConsumerStats returns the counters of the users that lost messages,
+// ordered by user ID. Counters are kept across reconnects, until the user's
+// session expires.
+func (server *Server) SlowConsumerStats() []SlowConsumerStats {
+	var stats []SlowConsumerStats
+
+	server.slowConsumers.Range(func(userID, value interface{}) bool {
+		counters := value.(*slowConsumerCounters)
+		userStats := SlowConsumerStats{
+			UserID:      userID.(uint64),
+			Dropped:     atomic.LoadUint64(&counters.dropped),
+			Disconnects: atomic.LoadUint64(&counters.disconnects),
+		}
+		if userStats.Dropped > 0 || userStats.Disconnects > 0 {
+			stats = append(stats, userStats)
+		}
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].UserID < stats[j].UserID })
+	return stats
+}
+
+func (server *Server) slowConsumerCounters(userID uint64) *slowConsumerCounters {
+	value, _ := server.slowConsumers.LoadOrStore(userID, &slowConsumerCounters{})
+	return value.(*slowConsumerCounters)
+}
+
+// forgetSlowConsumer drops the counters of a client that left without losing
+// messages.
+func (server *Server) forgetSlowConsumer(client *connection) {
+	if atomic.LoadUint64(&client.counters.dropped) == 0 && atomic.LoadUint64(&client.counters.disconnects) == 0 {
+		server.slowConsumers.CompareAndDelete(client.userID, client.counters)
+	}
+}
+
+// expireSlowConsumers drops the counters of the users that are not connected
+// and no longer have a session to come back with.
+func (server *Server) expireSlowConsumers() {
+	server.slowConsumers.Range(func(userID, _ interface{}) bool {
+		if !server.isConnected(userID.(uint64)) && !server.sessions.has(userID.(uint64)) {
+			server.slowConsumers.Delete(userID)
+		}
+		return true
+	})
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"message-delivery-system/internal/metrics"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// newStalledConnection returns a connection whose client does not read, with
+// one frame being written and another one filling its outbound queue.
+func newStalledConnection(t *testing.T, policy SlowConsumerPolicy) (*connection, net.Conn) {
+	serverSide, clientSide := net.Pipe()
+	client := newConnection(serverSide, 1, protocol.Version, protocol.LittleEndian, 1, policy, &slowConsumerCounters{}, newServerMetrics(metrics.NewRegistry()), slog.Default())
+
+	require.NoError(t, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, RequestID: 1}))
+	require.Eventually(t, func() bool { return len(client.outbound) == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, RequestID: 2}))
+	return client, clientSide
+}
+
+func TestDropNewestPolicy(t *testing.T) {
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: DropNewest})
+	defer clientSide.Close()
+	defer client.Close()
+
+	assert.Equal(t, errOutboundQueueFull, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage}))
+	assert.Equal(t, uint64(1), client.counters.dropped)
+}
+
+func TestDropOldestPolicy(t *testing.T) {
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: DropOldest})
+	defer clientSide.Close()
+	defer client.Close()
+
+	assert.NoError(t, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, RequestID: 100}))
+	assert.Equal(t, uint64(1), client.counters.dropped)
+
+	// The frame being written when the queue filled up comes first, then the newest one.
+	frame, err := protocol.ReadFrame(clientSide)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), frame.RequestID)
+	frame, err = protocol.ReadFrame(clientSide)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100), frame.RequestID)
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: Disconnect, Threshold: 1})
+	defer clientSide.Close()
+
+	message := protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage}
+	assert.Equal(t, errOutboundQueueFull, client.relay(message), "the first drop should be tolerated")
+	assert.Equal(t, errSlowConsumer, client.relay(message))
+	assert.Equal(t, uint64(2), client.counters.dropped)
+	assert.Equal(t, uint64(1), client.counters.disconnects)
+	assert.Equal(t, errConnectionClosed, client.relay(message))
+}
+
+func TestBlockWithTimeoutPolicy(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: BlockWithTimeout, Timeout: timeout})
+	defer clientSide.Close()
+	defer client.Close()
+
+	started := time.Now()
+	assert.Equal(t, errOutboundQueueFull, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage}))
+	assert.True(t, time.Since(started) >= timeout, "the sender should wait for the timeout")
+	assert.Equal(t, uint64(1), client.counters.dropped)
+
+	go func() {
+		for {
+			if _, err := protocol.ReadFrame(clientSide); err != nil {
+				return
+			}
+		}
+	}()
+	assert.NoError(t, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage}),
+		"the message should be queued once the client reads again")
+}
+
+func TestNotifyDoesNotWait(t *testing.T) {
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: BlockWithTimeout, Timeout: time.Minute})
+	defer clientSide.Close()
+	defer client.Close()
+
+	started := time.Now()
+	assert.Equal(t, errOutboundQueueFull, client.notify(protocol.Frame{Version: protocol.Version, Type: protocol.FrameUserJoined}))
+	assert.Less(t, time.Since(started), time.Second, "hub notifications should not wait for room in the queue")
+	assert.Equal(t, uint64(1), client.counters.dropped)
+}
+
+func TestSlowConsumerStats(t *testing.T) {
+	srv := New()
+	srv.SetOutboundQueueSize(1)
+	srv.SetSlowConsumerPolicy(SlowConsumerPolicy{Action: Disconnect})
+	serverAddr := net.TCPAddr{Port: 9015}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	sender, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, receiverID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	// The receiver never reads, so the socket buffers and then its queue fill up.
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{receiverID}, make([]byte, 1024*1024))
+	require.NoError(t, err)
+	var status protocol.RelayStatus
+	for requestID := uint32(1); len(status.Failed) == 0; requestID++ {
+		require.Less(t, requestID, uint32(100), "the receiver should be shed")
+		require.NoError(t, writeRequest(sender, protocol.FrameRelay, requestID, payload))
+		response, err := protocol.ReadFrame(sender)
+		require.NoError(t, err)
+		status, err = protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []SlowConsumerStats{{UserID: receiverID, Dropped: 1, Disconnects: 1}}, srv.SlowConsumerStats())
+	assert.NotContains(t, srv.ListClientIDs(), receiverID, "the slow consumer should be disconnected")
+}
+
+func TestDropOldestPolicyKeepsControlFrames(t *testing.T) {
+	client, clientSide := newStalledConnection(t, SlowConsumerPolicy{Action: DropOldest})
+	defer clientSide.Close()
+	defer client.Close()
+
+	require.NoError(t, client.send(protocol.Frame{Version: protocol.Version, Type: protocol.FrameRelayStatus, RequestID: 50}))
+	assert.NoError(t, client.relay(protocol.Frame{Version: protocol.Version, Type: protocol.FrameMessage, RequestID: 100}))
+	assert.Equal(t, uint64(1), client.counters.dropped)
+
+	for _, requestID := range []uint32{1, 50, 100} {
+		frame, err := protocol.ReadFrame(clientSide)
+		require.NoError(t, err)
+		assert.Equal(t, requestID, frame.RequestID, "the response should not be evicted")
+	}
+}
+
+func TestSlowConsumerCountersAreForgotten(t *testing.T) {
+	srv := New()
+	srv.sessions.create("kept", 1)
+	srv.slowConsumerCounters(1).dropped = 1
+	srv.slowConsumerCounters(2).dropped = 1
+	quiet := &connection{userID: 3, counters: srv.slowConsumerCounters(3)}
+
+	srv.forgetSlowConsumer(quiet)
+	_, ok := srv.slowConsumers.Load(uint64(3))
+	assert.False(t, ok, "counters of a user that lost nothing should be dropped on leaving")
+
+	srv.sweep(time.Now())
+	assert.Equal(t, []SlowConsumerStats{{UserID: 1, Dropped: 1}}, srv.SlowConsumerStats(), "counters of users without a session should be dropped")
+}
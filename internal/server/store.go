@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStoreFull is returned by Store when keeping the message would exceed the
+// store's limits.
+var ErrStoreFull = errors.New("server: message store full")
+
+// StoredMessage is a relayed message queued for a recipient that was not connected.
+type StoredMessage struct {
+	SenderID uint64
+	Body     []byte
+	StoredAt time.Time
+}
+
+// MessageStore queues messages for disconnected recipients until they reconnect.
+// Implementations must be safe for concurrent use.
+type MessageStore interface {
+	// Store queues a message for the recipient.
+	Store(recipientID uint64, message StoredMessage) error
+	// Flush removes and returns the unexpired messages queued for the
+	// recipient, oldest first. With an error it may still return the
+	// messages it could read.
+	Flush(recipientID uint64) ([]StoredMessage, error)
+}
+
+// ExpiringStore is a MessageStore whose messages expire after a TTL. The hub
+// calls Expire periodically, so messages for recipients that never come back
+// do not pile up, and keeps storing messages for a user until the user has
+// been gone for the TTL.
+type ExpiringStore interface {
+	MessageStore
+	TTL() time.Duration
+	// Expire drops the messages stored longer than the TTL before now.
+	Expire(now time.Time) error
+}
+
+// StoreLimits bound what a store keeps. Zero fields take the values of
+// DefaultStoreLimits.
+type StoreLimits struct {
+	// MaxPerRecipient is how many messages may be queued for one recipient.
+	MaxPerRecipient int
+	// MaxTotalBytes is how many bytes of message bodies may be stored for all
+	// recipients together.
+	MaxTotalBytes int64
+}
+
+var DefaultStoreLimits = StoreLimits{MaxPerRecipient: 1000, MaxTotalBytes: 256 * 1024 * 1024}
+
+func (limits StoreLimits) withDefaults() StoreLimits {
+	if limits.MaxPerRecipient <= 0 {
+		limits.MaxPerRecipient = DefaultStoreLimits.MaxPerRecipient
+	}
+	if limits.MaxTotalBytes <= 0 {
+		limits.MaxTotalBytes = DefaultStoreLimits.MaxTotalBytes
+	}
+	return limits
+}
+
+// MemoryStore keeps queued messages in memory. Messages older than the TTL
+// are discarded.
+type MemoryStore struct {
+	ttl    time.Duration
+	limits StoreLimits
+	queues map[uint64][]StoredMessage
+	// bytes is the size of the bodies of the queued messages.
+	bytes int64
+	mutex sync.Mutex
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, limits: DefaultStoreLimits, queues: make(map[uint64][]StoredMessage)}
+}
+
+// SetLimits bounds the messages the store keeps.
+func (store *MemoryStore) SetLimits(limits StoreLimits) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.limits = limits.withDefaults()
+}
+
+func (store *MemoryStore) TTL() time.Duration {
+	return store.ttl
+}
+
+func (store *MemoryStore) Store(recipientID uint64, message StoredMessage) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	queue := store.unexpired(recipientID, time.Now())
+	if len(queue) >= store.limits.MaxPerRecipient || store.bytes+int64(len(message.Body)) > store.limits.MaxTotalBytes {
+		return ErrStoreFull
+	}
+	store.queues[recipientID] = append(queue, message)
+	store.bytes += int64(len(message.Body))
+	return nil
+}
+
+func (store *MemoryStore) Flush(recipientID uint64) ([]StoredMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	queue := store.unexpired(recipientID, time.Now())
+	delete(store.queues, recipientID)
+	store.bytes -= bodiesLength(queue)
+	return queue, nil
+}
+
+func (store *MemoryStore) Expire(now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for recipientID := range store.queues {
+		store.unexpired(recipientID, now)
+	}
+	return nil
+}
+
+// unexpired drops the expired messages of the recipient and returns the
+// others. The caller must hold the mutex.
+func (store *MemoryStore) unexpired(recipientID uint64, now time.Time) []StoredMessage {
+	queue := store.queues[recipientID]
+	fresh := unexpired(queue, store.ttl, now)
+	store.bytes -= bodiesLength(queue[:len(queue)-len(fresh)])
+	if len(fresh) == 0 {
+		delete(store.queues, recipientID)
+	} else {
+		store.queues[recipientID] = fresh
+	}
+	return fresh
+}
+
+// unexpired drops the leading messages that are older than the TTL. Queues are
+// ordered by StoredAt, so everything after the first fresh message is kept.
+func unexpired(queue []StoredMessage, ttl time.Duration, now time.Time) []StoredMessage {
+	for i, message := range queue {
+		if now.Sub(message.StoredAt) < ttl {
+			return queue[i:]
+		}
+	}
+	return nil
+}
+
+func bodiesLength(messages []StoredMessage) int64 {
+	var length int64
+	for _, message := range messages {
+		length += int64(len(message.Body))
+	}
+	return length
+}
+
+// issuedUsers remembers the user IDs the hub handed out and when each user
+// was last seen, so that messages are only stored for users that may come
+// back for them.
+type issuedUsers struct {
+	lastSeen map[uint64]time.Time
+	mutex    sync.Mutex
+}
+
+func newIssuedUsers() *issuedUsers {
+	return &issuedUsers{lastSeen: make(map[uint64]time.Time)}
+}
+
+func (users *issuedUsers) touch(userID uint64) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	users.lastSeen[userID] = time.Now()
+}
+
+func (users *issuedUsers) issued(userID uint64) bool {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	_, ok := users.lastSeen[userID]
+	return ok
+}
+
+// expire forgets the users last seen before the time that are not connected.
+func (users *issuedUsers) expire(before time.Time, isConnected func(userID uint64) bool) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	for userID, lastSeen := range users.lastSeen {
+		if lastSeen.Before(before) && !isConnected(userID) {
+			delete(users.lastSeen, userID)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testMessageStore(t *testing.T, store MessageStore, expire func()) {
+	first := StoredMessage{SenderID: 1, Body: []byte("first"), StoredAt: time.Now()}
+	second := StoredMessage{SenderID: 2, Body: []byte("second"), StoredAt: time.Now()}
+	require.NoError(t, store.Store(42, first))
+	require.NoError(t, store.Store(42, second))
+	require.NoError(t, store.Store(43, first))
+
+	messages, err := store.Flush(42)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, first.SenderID, messages[0].SenderID)
+	assert.Equal(t, first.Body, messages[0].Body)
+	assert.Equal(t, second.SenderID, messages[1].SenderID)
+	assert.Equal(t, second.Body, messages[1].Body)
+
+	messages, err = store.Flush(42)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "flushed messages should not be delivered twice")
+
+	expire()
+	messages, err = store.Flush(43)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "expired messages should be dropped")
+}
+
+func TestMemoryStore(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	testMessageStore(t, NewMemoryStore(ttl), func() { time.Sleep(ttl) })
+}
+
+func TestFileStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	ttl := 50 * time.Millisecond
+	store, err := NewFileStore(directory, ttl)
+	require.NoError(t, err)
+	testMessageStore(t, store, func() { time.Sleep(ttl) })
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.Store(7, StoredMessage{SenderID: 1, Body: []byte("persisted"), StoredAt: time.Now()}))
+
+	reopened, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	messages, err := reopened.Flush(7)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("persisted"), messages[0].Body)
+}
+
+func testStoreLimits(t *testing.T, store interface {
+	MessageStore
+	SetLimits(StoreLimits)
+}) {
+	store.SetLimits(StoreLimits{MaxPerRecipient: 2, MaxTotalBytes: 10})
+	message := StoredMessage{SenderID: 1, Body: []byte("four"), StoredAt: time.Now()}
+	require.NoError(t, store.Store(1, message))
+	require.NoError(t, store.Store(1, message))
+	assert.Equal(t, ErrStoreFull, store.Store(1, message), "the recipient's queue should be full")
+	assert.Equal(t, ErrStoreFull, store.Store(2, StoredMessage{Body: []byte("three"), StoredAt: time.Now()}), "the store should be full")
+
+	_, err := store.Flush(1)
+	require.NoError(t, err)
+	assert.NoError(t, store.Store(2, message), "flushed messages should free the store")
+}
+
+func TestMemoryStoreLimits(t *testing.T) {
+	testStoreLimits(t, NewMemoryStore(time.Hour))
+}
+
+func TestFileStoreLimits(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	testStoreLimits(t, store)
+}
+
+func testStoreExpire(t *testing.T, store ExpiringStore) {
+	now := time.Now()
+	stale := StoredMessage{SenderID: 1, Body: []byte("stale"), StoredAt: now.Add(-2 * store.TTL())}
+	fresh := StoredMessage{SenderID: 2, Body: []byte("fresh"), StoredAt: now}
+	require.NoError(t, store.Store(1, stale))
+	require.NoError(t, store.Store(1, fresh))
+	require.NoError(t, store.Store(2, stale))
+
+	require.NoError(t, store.Expire(now))
+
+	messages, err := store.Flush(1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, fresh.Body, messages[0].Body)
+	messages, err = store.Flush(2)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestMemoryStoreExpire(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	testStoreExpire(t, store)
+	assert.Empty(t, store.queues)
+	assert.Zero(t, store.bytes)
+}
+
+func TestFileStoreExpire(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	testStoreExpire(t, store)
+	assert.Empty(t, store.queues)
+	assert.Zero(t, store.bytes)
+
+	entries, err := os.ReadDir(directory)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "expired queue files should be removed")
+}
+
+func TestFileStoreExpireKeepsQueueWhenRewriteFails(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	require.NoError(t, store.Store(1, StoredMessage{SenderID: 1, Body: []byte("stale"), StoredAt: now.Add(-2 * time.Hour)}))
+	require.NoError(t, store.Store(1, StoredMessage{SenderID: 2, Body: []byte("fresh"), StoredAt: now}))
+
+	// A directory in the way of the temporary file makes the rewrite fail.
+	require.NoError(t, os.Mkdir(store.queuePath(1)+".tmp", 0700))
+	assert.Error(t, store.Expire(now))
+	assert.Equal(t, 2, store.queues[1].messages)
+
+	messages, err := store.Flush(1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("fresh"), messages[0].Body)
+}
+
+func TestFileStoreQuarantinesCorruptQueues(t *testing.T) {
+	directory, err := ioutil.TempDir("", "message-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.Store(7, StoredMessage{SenderID: 1, Body: []byte("intact"), StoredAt: time.Now()}))
+	file, err := os.OpenFile(store.queuePath(7), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("truncated"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reopened, err := NewFileStore(directory, time.Hour)
+	require.NoError(t, err)
+	assert.FileExists(t, store.queuePath(7)+".corrupt")
+	assert.Equal(t, 1, reopened.queues[7].messages)
+
+	messages, err := reopened.Flush(7)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("intact"), messages[0].Body)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// defaultIssuedRetention is how long messages are stored for a user that
+// left, with a store that is not an ExpiringStore.
+const defaultIssuedRetention = 24 * time.Hour
+
+// storeLockStripes is how many locks the users' stored messages share.
+const storeLockStripes = 64
+
+// startSweeping drops expired state every sweep interval until the server
+// stops.
+func (server *Server) startSweeping() {
+	server.sweepOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(server.sweepInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case now := <-ticker.C:
+					server.sweep(now)
+				case <-server.quit:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// sweep drops the expired sessions, the slow consumer counters of the users
+// that cannot come back and the expired stored messages, and forgets the users
+// messages are no longer stored for.
+func (server *Server) sweep(now time.Time) {
+	server.sessions.expire(now, server.isConnected)
+	server.expireSlowConsumers()
+	if server.store == nil {
+		return
+	}
+
+	retention := defaultIssuedRetention
+	if store, ok := server.store.(ExpiringStore); ok {
+		retention = store.TTL()
+		err := store.Expire(now)
+		if err != nil {
+			server.logger.Error("Expiring stored messages failed", "error", err)
+		}
+	}
+	server.issued.expire(now.Add(-retention), server.isConnected)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"message-delivery-system/internal/protocol"
+	"sort"
+	"sync"
+)
+
+// topicRegistry tracks which users subscribe to which topics.
+type topicRegistry struct {
+	members map[string]map[uint64]struct{}
+	byUser  map[uint64]map[string]struct{}
+	mutex   sync.RWMutex
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		members: make(map[string]map[uint64]struct{}),
+		byUser:  make(map[uint64]map[string]struct{}),
+	}
+}
+
+func (registry *topicRegistry) subscribe(topic string, userID uint64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.members[topic] == nil {
+		registry.members[topic] = make(map[uint64]struct{})
+	}
+	registry.members[topic][userID] = struct{}{}
+	if registry.byUser[userID] == nil {
+		registry.byUser[userID] = make(map[string]struct{})
+	}
+	registry.byUser[userID][topic] = struct{}{}
+}
+
+func (registry *topicRegistry) unsubscribe(topic string, userID uint64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.remove(topic, userID)
+}
+
+// unsubscribeAll drops every subscription of the user.
+func (registry *topicRegistry) unsubscribeAll(userID uint64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for topic := range registry.byUser[userID] {
+		registry.remove(topic, userID)
+	}
+}
+
+// remove drops one subscription and forgets empty topics. The caller must hold the mutex.
+func (registry *topicRegistry) remove(topic string, userID uint64) {
+	delete(registry.members[topic], userID)
+	if len(registry.members[topic]) == 0 {
+		delete(registry.members, topic)
+	}
+	delete(registry.byUser[userID], topic)
+	if len(registry.byUser[userID]) == 0 {
+		delete(registry.byUser, userID)
+	}
+}
+
+// list returns the subscribers of the topic ordered by user ID.
+func (registry *topicRegistry) list(topic string) []uint64 {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	userIDs := make([]uint64, 0, len(registry.members[topic]))
+	for userID := range registry.members[topic] {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	return userIDs
+}
+
+// dropSubscriptions forgets the topics of users that disconnected.
+func (server *Server) dropSubscriptions(event LifecycleEvent) {
+	if event.Type == ClientDisconnected {
+		server.topics.unsubscribeAll(event.UserID)
+	}
+}
+
+func decodeTopicRequest(client *connection, request protocol.Frame) (string, bool) {
+	topic, err := protocol.DecodeTopic(request.Payload)
+	if err != nil {
+		client.logger.Warn("Malformed request", "message_type", request.Type.String(), "error", err)
+		client.sendError(request, protocol.ErrorMalformedRequest, err.Error())
+		return "", false
+	}
+	return topic, true
+}
+
+var handleSubscribeRequest = func(server *Server, client *connection, request protocol.Frame) {
+	topic, ok := decodeTopicRequest(client, request)
+	if !ok {
+		return
+	}
+
+	server.topics.subscribe(topic, client.userID)
+	err := client.respond(request, protocol.FrameAck, nil)
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+var handleUnsubscribeRequest = func(server *Server, client *connection, request protocol.Frame) {
+	topic, ok := decodeTopicRequest(client, request)
+	if !ok {
+		return
+	}
+
+	server.topics.unsubscribe(topic, client.userID)
+	err := client.respond(request, protocol.FrameAck, nil)
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+var handleTopicMembersRequest = func(server *Server, client *connection, request protocol.Frame) {
+	topic, ok := decodeTopicRequest(client, request)
+	if !ok {
+		return
+	}
+
+	payload, err := protocol.EncodeUserIDs(client.codec, server.topics.list(topic))
+	if err != nil {
+		client.logger.Error("Encoding response failed", "message_type", request.Type.String(), "error", err)
+		return
+	}
+
+	err = client.respond(request, protocol.FrameWhoIsHereResponse, payload)
+	if err == protocol.ErrFrameTooLarge {
+		client.sendError(request, protocol.ErrorLimitExceeded, "too many topic members to list")
+		return
+	}
+	if err != nil {
+		client.logger.Warn("Sending response failed", "message_type", request.Type.String(), "error", err)
+	}
+}
+
+// handlePublishRequest relays the message to every subscriber of the topic
+// except the publisher and answers with a `relay_status` frame.
+var handlePublishRequest = func(server *Server, publisher *connection, request protocol.Frame) {
+	topic, body, err := protocol.DecodePublish(request.Payload)
+	if err != nil {
+		publisher.logger.Warn("Malformed request", "message_type", request.Type.String(), "error", err)
+		publisher.sendError(request, protocol.ErrorMalformedRequest, "malformed publish request")
+		return
+	}
+	if maxLength := protocol.MaxTopicMessageLength(topic); len(body) > maxLength {
+		publisher.sendError(request, protocol.ErrorLimitExceeded, fmt.Sprintf("message to topic %s exceeds %d bytes", topic, maxLength))
+		return
+	}
+
+	var status protocol.RelayStatus
+	message := protocol.Frame{Type: protocol.FrameTopicMessage, Payload: protocol.EncodeTopicMessage(topic, publisher.userID, body)}
+	for _, subscriber := range server.topics.list(topic) {
+		if subscriber == publisher.userID {
+			continue
+		}
+
+		value, ok := server.connections.Load(subscriber)
+		if !ok {
+			server.metrics.messagesDropped.With("offline").Inc()
+			status.Offline = append(status.Offline, subscriber)
+			continue
+		}
+		server.deliver(value.(*connection), message, &status)
+	}
+
+	server.metrics.observeFanOut(status)
+
+	payload, err := status.Encode(publisher.codec)
+	if err != nil {
+		publisher.logger.Error("Encoding relay status failed", "message_type", request.Type.String(), "error", err)
+		return
+	}
+
+	err = publisher.respond(request, protocol.FrameRelayStatus, payload)
+	if err != nil {
+		publisher.logger.Warn("Sending relay status failed", "message_type", request.Type.String(), "error", err)
+	}
+}
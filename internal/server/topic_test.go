@@ -0,0 +1,122 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTopicRegistry(t *testing.T) {
+	registry := newTopicRegistry()
+	registry.subscribe("news", 2)
+	registry.subscribe("news", 1)
+	registry.subscribe("sports", 1)
+	assert.Equal(t, []uint64{1, 2}, registry.list("news"))
+
+	registry.unsubscribe("news", 2)
+	assert.Equal(t, []uint64{1}, registry.list("news"))
+
+	registry.unsubscribeAll(1)
+	assert.Empty(t, registry.list("news"))
+	assert.Empty(t, registry.list("sports"))
+	assert.Empty(t, registry.members, "empty topics should be forgotten")
+	assert.Empty(t, registry.byUser)
+}
+
+func TestPublishToTopic(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9019}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	publisher, publisherID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer publisher.Close()
+	subscriber, subscriberID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	leaving, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+
+	topic, err := protocol.EncodeTopic("news")
+	require.NoError(t, err)
+	for _, clientConnection := range []net.Conn{publisher, subscriber, leaving} {
+		require.NoError(t, writeRequest(clientConnection, protocol.FrameSubscribe, 1, topic))
+		response, err := protocol.ReadFrame(clientConnection)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.FrameAck, response.Type)
+	}
+
+	require.NoError(t, leaving.Close())
+	assert.Eventually(t, func() bool {
+		require.NoError(t, writeRequest(publisher, protocol.FrameTopicMembers, 2, topic))
+		response, err := protocol.ReadFrame(publisher)
+		require.NoError(t, err)
+		members, err := protocol.DecodeUserIDs(protocol.LittleEndian, response.Payload)
+		require.NoError(t, err)
+		return len(members) == 2
+	}, time.Second, 10*time.Millisecond, "disconnected users should leave their topics")
+
+	payload, err := protocol.EncodePublish("news", []byte("headline"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(publisher, protocol.FramePublish, 3, payload))
+
+	response, err := protocol.ReadFrame(publisher)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameRelayStatus, response.Type)
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{subscriberID}, status.Delivered, "the publisher should not get its own message")
+
+	message, err := protocol.ReadFrame(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameTopicMessage, message.Type)
+	messageTopic, senderID, body, err := protocol.DecodeTopicMessage(message.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, "news", messageTopic)
+	assert.Equal(t, publisherID, senderID)
+	assert.Equal(t, []byte("headline"), body)
+}
+
+func TestPublishRejectsTooLongBody(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9042}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	publisher, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	// The request fits in a frame, but the topic message would not.
+	payload, err := protocol.EncodePublish("news", make([]byte, protocol.MaxTopicMessageLength("news")+1))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(publisher, protocol.FramePublish, 1, payload))
+	response, err := protocol.ReadFrame(publisher)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ErrorLimitExceeded, protocolError.Code)
+}
+
+func TestSubscribeRejectsInvalidTopic(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9020}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer srv.Stop()
+
+	clientConnection, _, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer clientConnection.Close()
+
+	require.NoError(t, writeRequest(clientConnection, protocol.FrameSubscribe, 1, nil))
+	response, err := protocol.ReadFrame(clientConnection)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameError, response.Type)
+	protocolError, err := protocol.DecodeError(response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ErrorMalformedRequest, protocolError.Code)
+}
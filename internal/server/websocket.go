@@ -0,0 +1,38 @@
+package server
+
+import (
+	"message-delivery-system/internal/websocket"
+	"net"
+	"net/http"
+)
+
+// StartWebSocket accepts clients over WebSocket on laddr, on any path, next to
+// the TCP listener of Start. The clients send and receive the same frames as
+// TCP clients, one or more per binary message, and share the registry of
+// connected users with them. When a TLS config is set, the listener serves
+// wss:// only.
+func (server *Server) StartWebSocket(laddr *net.TCPAddr) error {
+	return server.serveHTTP(laddr, server.WebSocketHandler(), server.tlsConfig)
+}
+
+// WebSocketHandler upgrades requests to WebSocket connections and handles them
+// like the connections accepted by Start. Use it to serve clients from an
+// existing HTTP server instead of StartWebSocket.
+func (server *Server) WebSocketHandler() http.Handler {
+	server.startSweeping()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.stopping() {
+			http.Error(w, "hub is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			server.logger.Warn("Upgrading to WebSocket failed", "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+
+		server.track(conn)
+		server.handleConnection(conn)
+	})
+}
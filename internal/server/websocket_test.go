@@ -0,0 +1,77 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"message-delivery-system/internal/protocol"
+	"message-delivery-system/internal/websocket"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebSocketClientsShareTheRegistry(t *testing.T) {
+	srv := New()
+	serverAddr := net.TCPAddr{Port: 9023}
+	webSocketAddr := net.TCPAddr{Port: 9024}
+	require.NoError(t, srv.Start(&serverAddr))
+	require.NoError(t, srv.StartWebSocket(&webSocketAddr))
+	defer srv.Stop()
+
+	tcpClient, tcpUserID, err := dialAndHandshake(&serverAddr)
+	require.NoError(t, err)
+	defer tcpClient.Close()
+
+	browser, err := websocket.Dial("ws://"+webSocketAddr.String()+"/hub", nil)
+	require.NoError(t, err)
+	defer browser.Close()
+	hello := protocol.Hello{MinVersion: protocol.MinVersion, MaxVersion: protocol.Version}
+	require.NoError(t, writeRequest(browser, protocol.FrameHello, 0, hello.Encode()))
+	response, err := protocol.ReadFrame(browser)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameWelcome, response.Type)
+	welcome, err := protocol.DecodeWelcome(response.Payload)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []uint64{tcpUserID, welcome.UserID}, srv.ListClientIDs())
+
+	payload, err := protocol.EncodeRelay(protocol.LittleEndian, []uint64{tcpUserID}, []byte("from the browser"))
+	require.NoError(t, err)
+	require.NoError(t, writeRequest(browser, protocol.FrameRelay, 1, payload))
+
+	message, err := protocol.ReadFrame(tcpClient)
+	require.NoError(t, err)
+	require.Equal(t, protocol.FrameMessage, message.Type)
+	senderID, body, err := protocol.DecodeMessage(message.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, welcome.UserID, senderID)
+	assert.Equal(t, "from the browser", string(body))
+
+	response, err = protocol.ReadFrame(browser)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.FrameRelayStatus, response.Type)
+	status, err := protocol.DecodeRelayStatus(protocol.LittleEndian, response.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{tcpUserID}, status.Delivered)
+}
+
+func TestWebSocketUpgradeTimeout(t *testing.T) {
+	srv := New(WithHandshakeTimeout(100 * time.Millisecond))
+	serverAddr := net.TCPAddr{Port: 9043}
+	webSocketAddr := net.TCPAddr{Port: 9044}
+	require.NoError(t, srv.Start(&serverAddr))
+	require.NoError(t, srv.StartWebSocket(&webSocketAddr))
+	defer srv.Stop()
+
+	// A client that never finishes its upgrade request is cut off.
+	stalled, err := net.Dial("tcp", webSocketAddr.String())
+	require.NoError(t, err)
+	defer stalled.Close()
+	_, err = stalled.Write([]byte("GET /hub HTTP/1.1\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, stalled.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadAll(stalled)
+	assert.NoError(t, err, "the hub should close the connection before the read deadline")
+}
@@ -1,9 +1,42 @@
 package utility
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	mathrand "math/rand"
+	"sync/atomic"
 )
 
 func GenerateID() uint64 {
-	return rand.Uint64()
+	return mathrand.Uint64()
+}
+
+// NewSequentialIDGenerator returns a generator of the IDs 1, 2, 3 and so on,
+// safe for concurrent use. IDs start over when the process restarts.
+func NewSequentialIDGenerator() func() uint64 {
+	var last uint64
+	return func() uint64 {
+		return atomic.AddUint64(&last, 1)
+	}
+}
+
+// GenerateIDFromSubject derives a stable user ID from an authenticated subject,
+// so the same subject gets the same ID on every connection. The ID is the
+// first 8 bytes of the subject's SHA-256, so subjects cannot be crafted to
+// take over another subject's ID.
+func GenerateIDFromSubject(subject string) uint64 {
+	sum := sha256.Sum256([]byte(subject))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// GenerateToken returns a random, hex-encoded token that is hard to guess.
+func GenerateToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
 }
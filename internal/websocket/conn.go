@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+)
+
+// maxControlPayloadLength is the largest payload of a close, ping or pong frame.
+const maxControlPayloadLength = 125
+
+// closeTimeout bounds how long Close waits to write the close frame to a
+// peer that does not read.
+const closeTimeout = time.Second
+
+var (
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrUnsupportedData = errors.New("websocket: text messages are not supported")
+)
+
+// Conn is a WebSocket connection carrying a byte stream in binary messages.
+// Every Write is sent as one binary message; Read returns the payload of the
+// binary messages as they arrive, regardless of how they are fragmented. Pings
+// are answered and a close frame from the peer ends the stream with io.EOF.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	// client is set on the dialing side, which masks the frames it writes.
+	client bool
+
+	// remaining is how much of the current data frame's payload is unread.
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskIndex int
+	readErr   error
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: conn, reader: reader, client: client}
+}
+
+// ConnectionState returns the TLS state of the underlying connection, or the
+// zero state when it is not a TLS connection.
+func (conn *Conn) ConnectionState() tls.ConnectionState {
+	if tlsConnection, ok := conn.Conn.(*tls.Conn); ok {
+		return tlsConnection.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	for conn.remaining == 0 {
+		if conn.readErr != nil {
+			return 0, conn.readErr
+		}
+		err := conn.nextDataFrame()
+		if err != nil {
+			conn.readErr = err
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > conn.remaining {
+		p = p[:conn.remaining]
+	}
+	n, err := conn.reader.Read(p)
+	conn.remaining -= uint64(n)
+	if conn.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= conn.mask[conn.maskIndex]
+			conn.maskIndex = (conn.maskIndex + 1) % 4
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextDataFrame reads frame headers until one starts a binary payload,
+// handling the control frames in between.
+func (conn *Conn) nextDataFrame() error {
+	for {
+		var header [2]byte
+		_, err := io.ReadFull(conn.reader, header[:])
+		if err != nil {
+			return err
+		}
+
+		opcode := header[0] & 0x0f
+		if header[0]&0x70 != 0 {
+			// No extensions are negotiated, so the reserved bits must be clear.
+			conn.writeClose(closeProtocolError)
+			return ErrProtocol
+		}
+		masked := header[1]&0x80 != 0
+		if masked == conn.client {
+			// Clients mask every frame, servers none.
+			conn.writeClose(closeProtocolError)
+			return ErrProtocol
+		}
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var extended [2]byte
+			_, err = io.ReadFull(conn.reader, extended[:])
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			_, err = io.ReadFull(conn.reader, extended[:])
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+		if err != nil {
+			return err
+		}
+
+		var mask [4]byte
+		if masked {
+			_, err = io.ReadFull(conn.reader, mask[:])
+			if err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case opBinary, opContinuation:
+			conn.remaining, conn.masked, conn.mask, conn.maskIndex = length, masked, mask, 0
+			if length == 0 {
+				continue
+			}
+			return nil
+		case opText:
+			conn.writeClose(closeUnsupportedData)
+			return ErrUnsupportedData
+		case opClose, opPing, opPong:
+			if length > maxControlPayloadLength {
+				conn.writeClose(closeProtocolError)
+				return ErrProtocol
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(conn.reader, payload)
+			if err != nil {
+				return err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= mask[i%4]
+				}
+			}
+
+			switch opcode {
+			case opClose:
+				conn.writeClose(closeNormal)
+				return io.EOF
+			case opPing:
+				err = conn.writeFrame(opPong, payload)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			conn.writeClose(closeProtocolError)
+			return ErrProtocol
+		}
+	}
+}
+
+// Write sends p as a single binary message.
+func (conn *Conn) Write(p []byte) (int, error) {
+	err := conn.writeFrame(opBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	if conn.closeSent {
+		return net.ErrClosed
+	}
+	return conn.writeFrameLocked(opcode, payload)
+}
+
+func (conn *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if conn.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !conn.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame with the status code, once. It gives up
+// rather than wait for a write in progress, so a peer that stopped reading
+// cannot hold up closing the connection.
+func (conn *Conn) writeClose(code uint16) {
+	if !conn.writeMutex.TryLock() {
+		return
+	}
+	defer conn.writeMutex.Unlock()
+
+	if conn.closeSent {
+		return
+	}
+	conn.closeSent = true
+	conn.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	conn.writeFrameLocked(opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Close sends a close frame, if no write is in progress, and closes the
+// underlying connection.
+func (conn *Conn) Close() error {
+	conn.writeClose(closeNormal)
+	return conn.Conn.Close()
+}
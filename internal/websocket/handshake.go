@@ -0,0 +1,188 @@
+// Package websocket carries the hub's byte stream over WebSocket connections
+// (RFC 6455), so browsers can connect. It only implements what the hub needs:
+// binary messages, ping and close handling, and no extensions.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Upgrade answers a WebSocket opening handshake and takes over the HTTP
+// connection. When the request is not a valid handshake, it replies with an
+// HTTP error and returns ErrBadHandshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response writer does not support hijacking")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newConn(conn, buffered.Reader, false), nil
+}
+
+// Dial opens a WebSocket connection to a ws:// or wss:// URL. The TLS config
+// is used for wss:// URLs and may be nil.
+func Dial(rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	return DialContext(context.Background(), rawURL, tlsConfig)
+}
+
+// DialContext is like Dial but gives up dialing and the opening handshake
+// when ctx is done, returning ctx.Err().
+func DialContext(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch target.Scheme {
+	case "ws":
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(target, "80"))
+	case "wss":
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(target, "443"))
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", target.Scheme)
+	}
+	if err != nil {
+		return nil, dialError(ctx, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	keyBytes := make([]byte, 16)
+	_, err = rand.Read(keyBytes)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: target.Host,
+	}
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, dialError(ctx, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, dialError(ctx, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, ErrBadHandshake
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newConn(conn, reader, true), nil
+}
+
+// dialError returns the error of ctx for errors caused by ctx being done. The
+// deadline of the connection may pass just before ctx notices.
+func dialError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hostPort(target *url.URL, defaultPort string) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	return net.JoinHostPort(target.Hostname(), defaultPort)
+}
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPipe connects a server and a client Conn over loopback TCP, which unlike
+// net.Pipe buffers writes the peer has not read yet.
+func newPipe(t *testing.T) (*Conn, *Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverSide, err := listener.Accept()
+	require.NoError(t, err)
+	return newConn(serverSide, bufio.NewReader(serverSide), false), newConn(clientSide, bufio.NewReader(clientSide), true)
+}
+
+func TestDialAndUpgrade(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer httpServer.Close()
+
+	conn, err := Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/hub", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	message := strings.Repeat("x", 70000)
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+
+	echoed := make([]byte, len(message))
+	_, err = io.ReadFull(conn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, message, string(echoed))
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := Upgrade(w, r)
+		assert.Equal(t, ErrBadHandshake, err)
+	}))
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestReadJoinsFragmentsAndAnswersPings(t *testing.T) {
+	server, client := newPipe(t)
+	defer server.Conn.Close()
+	defer client.Conn.Close()
+
+	clientErr := make(chan error, 1)
+	reply := make(chan string, 1)
+	go func() {
+		// A message fragmented around a ping, as a browser may send it.
+		frames := [][]byte{
+			{opBinary, 0x80 | 3, 0, 0, 0, 0, 'h', 'e', 'l'},
+			{0x80 | opPing, 0x80 | 1, 0, 0, 0, 0, '!'},
+			{0x80 | opContinuation, 0x80 | 2, 0, 0, 0, 0, 'l', 'o'},
+		}
+		for _, frame := range frames {
+			_, err := client.Conn.Write(frame)
+			if err != nil {
+				clientErr <- err
+				return
+			}
+		}
+
+		// The pong is skipped on the way to the answer.
+		answer := make([]byte, 5)
+		_, err := io.ReadFull(client, answer)
+		clientErr <- err
+		reply <- string(answer)
+	}()
+
+	message := make([]byte, 5)
+	_, err := io.ReadFull(server, message)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+
+	_, err = server.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, <-clientErr)
+	assert.Equal(t, "world", <-reply)
+}
+
+func TestCloseEndsTheStream(t *testing.T) {
+	server, client := newPipe(t)
+	defer server.Close()
+
+	go client.Close()
+
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadRejectsInvalidFrames(t *testing.T) {
+	tests := map[string]struct {
+		frame []byte
+		err   error
+	}{
+		"text message":   {frame: []byte{0x80 | opText, 0x80 | 1, 0, 0, 0, 0, 'x'}, err: ErrUnsupportedData},
+		"unmasked frame": {frame: []byte{0x80 | opBinary, 1, 'x'}, err: ErrProtocol},
+		"reserved bits":  {frame: []byte{0xc0 | opBinary, 0x80 | 1, 0, 0, 0, 0, 'x'}, err: ErrProtocol},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := newPipe(t)
+			defer server.Close()
+			defer client.Conn.Close()
+
+			go func() {
+				client.Conn.Write(test.frame)
+				// Take the close frame the server answers with.
+				io.Copy(io.Discard, client.Conn)
+			}()
+
+			_, err := server.Read(make([]byte, 1))
+			assert.Equal(t, test.err, err)
+		})
+	}
+}
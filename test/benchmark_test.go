@@ -3,11 +3,11 @@ package test
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
 	"net"
 	"testing"
 	"time"
-	"message-delivery-system/internal/client"
-	"message-delivery-system/internal/server"
 )
 
 const clientCount = 10
@@ -43,7 +43,7 @@ func TestBenchmark(t *testing.T) {
 		payload := []byte("FOOBAR")
 		result := testing.Benchmark(func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				assert.NoError(b, clients[0].Broadcast(payload))
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
@@ -56,7 +56,7 @@ func TestBenchmark(t *testing.T) {
 		payload := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit. Duis sed est id mi blandit fringilla vulputate nec urna. Duis non porttitor arcu. Mauris ac ullamcorper turpis, ac tincidunt risus. In rutrum efficitur porttitor. Cras scelerisque eu mi ut tristique. Phasellus enim elit, pretium ut mi vel, semper interdum nisl. Duis gravida blandit risus, a semper ipsum lacinia quis. Nam eros purus, congue in metus id, volutpat dapibus velit. Cras ut dictum libero, non placerat quam. Vivamus sem justo, varius at magna sed, blandit consequat mi. Cras viverra, orci nec feugiat ullamcorper, mauris erat tincidunt nisi, nec rutrum neque est a libero. Nullam pharetra dolor at erat elementum convallis. Phasellus dictum fermentum odio non eleifend. Etiam scelerisque, neque a fringilla molestie, purus turpis posuere erat, ut pulvinar nisl nisl nec nisl. In pellentesque risus sem, id pretium eros gravida sit amet. In vel massa justo. Fusce euismod mattis massa. Fusce at nibh in est condimentum luctus. Integer a molestie arcu. Suspendisse aliquam venenatis nisl, sit amet aliquam ante convallis quis. Praesent nec ipsum lectus. Ut elementum pretium mollis. Etiam tincidunt sapien felis, eget aliquet justo tincidunt at. Integer turpis sem, feugiat quis lorem sed, scelerisque lacinia massa. Aliquam vitae urna et erat sodales accumsan a a enim. Nunc eget diam tristique, ornare nibh sed, laoreet ligula. Mauris sollicitudin consectetur elit nec eleifend. Donec in diam ut ligula porttitor vulputate. Integer finibus, tellus vitae sagittis tincidunt, felis augue pulvinar enim, consectetur sollicitudin lorem lacus vel sem. Mauris condimentum et dolor ac interdum. Praesent bibendum nulla nec dui tempus, non blandit augue iaculis. In pretium erat vel odio dictum, et rhoncus urna tristique. Mauris ut risus orci. Mauris cursus posuere felis, et accumsan ante consequat ac. Cras convallis luctus consequat.")
 		result := testing.Benchmark(func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				assert.NoError(b, clients[0].Broadcast(payload))
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
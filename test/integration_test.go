@@ -1,15 +1,19 @@
 package test
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"net"
-	"testing"
+	"message-delivery-system/internal/auth"
 	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/protocol"
 	"message-delivery-system/internal/server"
+	"net"
+	"testing"
 )
 
 const serverPort = 50002
+const authServerPort = 50003
 
 func TestIntegration(t *testing.T) {
 	srv := server.New()
@@ -62,6 +66,79 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, body, incomingMessage.Body)
 		assert.Equal(t, uint64(client1ID), incomingMessage.SenderID)
 	})
+
+	t.Run("Send message with receipt to a connected and an unknown client", func(t *testing.T) {
+		body := []byte("Did you get this?")
+		unknownID := client2ID + 1
+		report, err := client1.SendMsgWithReceipt(context.Background(), []uint64{client2ID, unknownID}, body)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{client2ID}, report.Delivered)
+		assert.Equal(t, []uint64{unknownID}, report.Offline)
+		assert.Empty(t, report.Failed)
+
+		incomingMessage := <-client2Ch
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, client1ID, incomingMessage.SenderID)
+	})
+
+	t.Run("Broadcast from the third client reaches the two other clients", func(t *testing.T) {
+		body := []byte("Hello everyone!")
+		assert.NoError(t, client3.Broadcast(body))
+
+		go client1.HandleIncomingMessages(client1Ch)
+		for _, clientCh := range []chan client.IncomingMessage{client1Ch, client2Ch} {
+			incomingMessage := <-clientCh
+			assert.Equal(t, body, incomingMessage.Body)
+			assert.Equal(t, client3ID, incomingMessage.SenderID)
+		}
+	})
+
+	t.Run("Reconnect keeps the user_id", func(t *testing.T) {
+		cli, id := createClientAndFetchID(t)
+		require.NoError(t, cli.Close())
+
+		serverAddr := net.TCPAddr{Port: serverPort}
+		require.NoError(t, cli.Connect(&serverAddr))
+		defer assertDoesNotError(t, cli.Close)
+		resumedID, err := cli.WhoAmI()
+		assert.NoError(t, err)
+		assert.Equal(t, id, resumedID)
+
+		other := client.New()
+		require.NoError(t, other.Connect(&serverAddr, client.WithSessionToken(cli.SessionToken())))
+		defer assertDoesNotError(t, other.Close)
+		otherID, err := other.WhoAmI()
+		assert.NoError(t, err)
+		assert.Equal(t, id, otherID, "another client presenting the token should take over the session")
+	})
+}
+
+func TestIntegrationWithAuthentication(t *testing.T) {
+	secret := []byte("shared-secret")
+	srv := server.New()
+	srv.SetAuthenticator(auth.NewSharedSecretAuthenticator(secret))
+
+	serverAddr := net.TCPAddr{Port: authServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	rejected := client.New()
+	err := rejected.Connect(&serverAddr, client.WithCredentials([]byte("guess")))
+	require.Error(t, err)
+	assert.Equal(t, protocol.ErrorUnauthorized, err.(*protocol.Error).Code)
+
+	cli := client.New()
+	require.NoError(t, cli.Connect(&serverAddr, client.WithCredentials(secret)))
+	id, err := cli.WhoAmI()
+	assert.NoError(t, err)
+	require.NoError(t, cli.Close())
+
+	// Credentials are kept for reconnecting.
+	require.NoError(t, cli.Connect(&serverAddr))
+	defer assertDoesNotError(t, cli.Close)
+	resumedID, err := cli.WhoAmI()
+	assert.NoError(t, err)
+	assert.Equal(t, id, resumedID)
 }
 
 func assertDoesNotError(tb testing.TB, fn func() error) {
@@ -0,0 +1,40 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
+	"net"
+	"testing"
+)
+
+const presenceServerPort = 50006
+
+func TestPresenceIntegration(t *testing.T) {
+	srv := server.New()
+	serverAddr := net.TCPAddr{Port: presenceServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	watcher := client.New()
+	require.NoError(t, watcher.Connect(&serverAddr))
+	defer assertDoesNotError(t, watcher.Close)
+	userIDs, err := watcher.SubscribePresence()
+	require.NoError(t, err)
+	assert.Empty(t, userIDs)
+
+	events := make(chan client.PresenceEvent)
+	go watcher.HandlePresenceEvents(events)
+
+	peer := client.New()
+	require.NoError(t, peer.Connect(&serverAddr))
+	peerID, err := peer.WhoAmI()
+	require.NoError(t, err)
+	assert.Equal(t, client.PresenceEvent{Type: client.UserJoined, UserID: peerID}, <-events)
+
+	require.NoError(t, peer.Close())
+	assert.Equal(t, client.PresenceEvent{Type: client.UserLeft, UserID: peerID}, <-events)
+
+	require.NoError(t, watcher.UnsubscribePresence())
+}
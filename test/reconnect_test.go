@@ -0,0 +1,83 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
+	"net"
+	"testing"
+	"time"
+)
+
+const reconnectServerPort = 50010
+
+func TestReconnectIntegration(t *testing.T) {
+	srv := server.New()
+	serverAddr := net.TCPAddr{Port: reconnectServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	states := make(chan client.StateChange, 32)
+	subscriber := client.New()
+	subscriber.OnStateChange(func(change client.StateChange) { states <- change })
+	backoff := client.Backoff{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, MaxAttempts: 3}
+	require.NoError(t, subscriber.Connect(&serverAddr, client.WithReconnect(backoff)))
+	subscriberID, err := subscriber.WhoAmI()
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Subscribe("news"))
+	assert.Equal(t, client.Connecting, (<-states).State)
+	assert.Equal(t, client.Connected, (<-states).State)
+
+	publisher := client.New()
+	require.NoError(t, publisher.Connect(&serverAddr))
+	defer publisher.Close()
+	publisherID, err := publisher.WhoAmI()
+	require.NoError(t, err)
+
+	incoming := make(chan client.IncomingMessage)
+	handlerDone := make(chan struct{})
+	go func() {
+		subscriber.HandleIncomingMessages(incoming)
+		close(handlerDone)
+	}()
+
+	require.True(t, srv.Disconnect(subscriberID))
+	disconnected := <-states
+	assert.Equal(t, client.Disconnected, disconnected.State)
+	assert.Error(t, disconnected.Err)
+	assert.Equal(t, client.StateChange{State: client.Connecting, Attempt: 1}, withoutTime(<-states))
+	assert.Equal(t, client.StateChange{State: client.Connected, Attempt: 1}, withoutTime(<-states))
+
+	resumedID, err := subscriber.WhoAmI()
+	require.NoError(t, err)
+	assert.Equal(t, subscriberID, resumedID, "reconnecting should resume the session")
+	require.Eventually(t, func() bool {
+		members, err := publisher.TopicMembers("news")
+		return err == nil && len(members) == 1
+	}, time.Second, 10*time.Millisecond, "reconnecting should subscribe to the topics again")
+
+	require.NoError(t, publisher.Publish("news", []byte("after reconnect")))
+	assert.Equal(t, client.IncomingMessage{SenderID: publisherID, Body: []byte("after reconnect"), Topic: "news"}, <-incoming)
+	require.NoError(t, publisher.SendMsg([]uint64{subscriberID}, []byte("direct")))
+	assert.Equal(t, client.IncomingMessage{SenderID: publisherID, Body: []byte("direct")}, <-incoming)
+
+	// Once the hub is gone for good the client gives up and the stream ends.
+	require.NoError(t, srv.Stop())
+	select {
+	case <-handlerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleIncomingMessages should return once reconnecting fails")
+	}
+	var attempts int
+	for len(states) > 0 {
+		if change := <-states; change.State == client.Connecting {
+			attempts++
+		}
+	}
+	assert.Equal(t, backoff.MaxAttempts, attempts)
+}
+
+func withoutTime(change client.StateChange) client.StateChange {
+	change.Time = time.Time{}
+	return change
+}
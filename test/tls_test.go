@@ -0,0 +1,136 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
+	"message-delivery-system/internal/utility"
+	"net"
+	"testing"
+	"time"
+)
+
+const tlsServerPort = 50004
+const mutualTLSServerPort = 50005
+
+type certificateAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+}
+
+func newCertificateAuthority(t *testing.T) *certificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &certificateAuthority{certificate: certificate, key: key, pool: pool}
+}
+
+func (ca *certificateAuthority) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newCertificateAuthority(t)
+	srv := server.New()
+	srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{ca.issue(t, "hub", x509.ExtKeyUsageServerAuth)}})
+
+	serverAddr := net.TCPAddr{Port: tlsServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	plain := client.New()
+	assert.Error(t, plain.Connect(&serverAddr), "plain TCP clients should not get through a TLS listener")
+
+	tlsConfig := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+	sender := client.New()
+	require.NoError(t, sender.Connect(&serverAddr, client.WithTLSConfig(tlsConfig)))
+	defer assertDoesNotError(t, sender.Close)
+
+	receiver := client.New()
+	require.NoError(t, receiver.Connect(&serverAddr, client.WithTLSConfig(tlsConfig)))
+	defer assertDoesNotError(t, receiver.Close)
+	receiverID, err := receiver.WhoAmI()
+	require.NoError(t, err)
+
+	receiverCh := make(chan client.IncomingMessage)
+	defer close(receiverCh)
+	go receiver.HandleIncomingMessages(receiverCh)
+
+	require.NoError(t, sender.SendMsg([]uint64{receiverID}, []byte("over TLS")))
+	incomingMessage := <-receiverCh
+	assert.Equal(t, []byte("over TLS"), incomingMessage.Body)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCertificateAuthority(t)
+	srv := server.New()
+	srv.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "hub", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	serverAddr := net.TCPAddr{Port: mutualTLSServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	anonymous := client.New()
+	err := anonymous.Connect(&serverAddr, client.WithTLSConfig(&tls.Config{RootCAs: ca.pool, ServerName: "localhost"}))
+	assert.Error(t, err, "clients without a certificate should be rejected")
+
+	alice := client.New()
+	aliceConfig := &tls.Config{
+		RootCAs:      ca.pool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+	}
+	require.NoError(t, alice.Connect(&serverAddr, client.WithTLSConfig(aliceConfig)))
+	defer assertDoesNotError(t, alice.Close)
+
+	aliceID, err := alice.WhoAmI()
+	require.NoError(t, err)
+	assert.Equal(t, utility.GenerateIDFromSubject("alice"), aliceID, "the certificate subject should determine the user_id")
+}
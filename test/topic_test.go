@@ -0,0 +1,47 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
+	"net"
+	"testing"
+)
+
+const topicServerPort = 50007
+
+func TestTopicsIntegration(t *testing.T) {
+	srv := server.New()
+	serverAddr := net.TCPAddr{Port: topicServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	publisher := client.New()
+	require.NoError(t, publisher.Connect(&serverAddr))
+	defer assertDoesNotError(t, publisher.Close)
+	publisherID, err := publisher.WhoAmI()
+	require.NoError(t, err)
+
+	subscriber := client.New()
+	require.NoError(t, subscriber.Connect(&serverAddr))
+	defer assertDoesNotError(t, subscriber.Close)
+	subscriberID, err := subscriber.WhoAmI()
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Subscribe("news"))
+
+	members, err := publisher.TopicMembers("news")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{subscriberID}, members)
+
+	incoming := make(chan client.IncomingMessage)
+	go subscriber.HandleIncomingMessages(incoming)
+	require.NoError(t, publisher.Publish("news", []byte("headline")))
+	assert.Equal(t, client.IncomingMessage{SenderID: publisherID, Body: []byte("headline"), Topic: "news"}, <-incoming)
+
+	require.NoError(t, subscriber.Unsubscribe("news"))
+	members, err = publisher.TopicMembers("news")
+	require.NoError(t, err)
+	assert.Empty(t, members)
+	assert.Error(t, publisher.Publish("", []byte("nowhere")), "topics must have a name")
+}
@@ -0,0 +1,50 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"message-delivery-system/internal/client"
+	"message-delivery-system/internal/server"
+	"net"
+	"testing"
+)
+
+const (
+	webSocketTCPServerPort = 50008
+	webSocketServerPort    = 50009
+)
+
+func TestWebSocketIntegration(t *testing.T) {
+	srv := server.New()
+	serverAddr := net.TCPAddr{Port: webSocketTCPServerPort}
+	webSocketAddr := net.TCPAddr{Port: webSocketServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	require.NoError(t, srv.StartWebSocket(&webSocketAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	tcpClient := client.New()
+	require.NoError(t, tcpClient.Connect(&serverAddr))
+	defer assertDoesNotError(t, tcpClient.Close)
+	tcpUserID, err := tcpClient.WhoAmI()
+	require.NoError(t, err)
+	tcpMessages := make(chan client.IncomingMessage)
+	go tcpClient.HandleIncomingMessages(tcpMessages)
+
+	webSocketClient := client.New()
+	require.NoError(t, webSocketClient.Connect(&webSocketAddr, client.WithWebSocket("/hub")))
+	defer assertDoesNotError(t, webSocketClient.Close)
+	webSocketUserID, err := webSocketClient.WhoAmI()
+	require.NoError(t, err)
+	webSocketMessages := make(chan client.IncomingMessage)
+	go webSocketClient.HandleIncomingMessages(webSocketMessages)
+
+	userIDs, err := webSocketClient.ListClientIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{tcpUserID}, userIDs)
+
+	require.NoError(t, webSocketClient.SendMsg([]uint64{tcpUserID}, []byte("over websocket")))
+	assert.Equal(t, client.IncomingMessage{SenderID: webSocketUserID, Body: []byte("over websocket")}, <-tcpMessages)
+
+	require.NoError(t, tcpClient.SendMsg([]uint64{webSocketUserID}, []byte("over tcp")))
+	assert.Equal(t, client.IncomingMessage{SenderID: tcpUserID, Body: []byte("over tcp")}, <-webSocketMessages)
+}